@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"zai-proxy/internal/zaistub"
+)
+
+func main() {
+	addr := flag.String("addr", ":9000", "listen address")
+	scriptDir := flag.String("scripts", "", "directory of <name>.json scripts")
+	delay := flag.Duration("delay", 20*time.Millisecond, "delay between SSE events")
+	flag.Parse()
+
+	var scripts map[string]zaistub.Script
+	if *scriptDir != "" {
+		var err error
+		scripts, err = zaistub.LoadScripts(*scriptDir)
+		if err != nil {
+			log.Fatalf("Failed to load scripts: %v", err)
+		}
+		log.Printf("Loaded %d scripts from %s", len(scripts), *scriptDir)
+	}
+
+	server := zaistub.NewServer(scripts, *delay)
+	log.Printf("zai-stub listening on %s", *addr)
+	if err := http.ListenAndServe(*addr, server.Handler()); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+}
@@ -7,4 +7,4 @@ require (
 	github.com/joho/godotenv v1.5.1
 )
 
-require github.com/corpix/uarand v0.2.0 // indirect
+require github.com/corpix/uarand v0.2.0
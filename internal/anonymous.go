@@ -1,9 +1,12 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 )
 
 type AnonymousAuthResponse struct {
@@ -11,8 +14,12 @@ type AnonymousAuthResponse struct {
 }
 
 // GetAnonymousToken 从 z.ai 获取匿名 token
-func GetAnonymousToken() (string, error) {
-	resp, err := http.Get("https://chat.z.ai/api/v1/auths/")
+func GetAnonymousToken(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", upstreamURL("/api/v1/auths/"), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := clientFor(ctx).Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -29,3 +36,154 @@ func GetAnonymousToken() (string, error) {
 
 	return authResp.Token, nil
 }
+
+type anonymousToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+// AnonymousTokenManager 缓存匿名 token，后台在过期前刷新并保持一个预热池
+type AnonymousTokenManager struct {
+	mu            sync.Mutex
+	tokens        []*anonymousToken
+	next          int
+	size          int
+	ttl           time.Duration
+	refreshBefore time.Duration
+	refilling     bool
+}
+
+var AnonTokens *AnonymousTokenManager
+
+func NewAnonymousTokenManager(size int, ttl, refreshBefore time.Duration) *AnonymousTokenManager {
+	if size < 1 {
+		size = 1
+	}
+	return &AnonymousTokenManager{
+		size:          size,
+		ttl:           ttl,
+		refreshBefore: refreshBefore,
+	}
+}
+
+// StartAnonymousTokenManager 预热匿名 token 池并启动后台刷新
+func StartAnonymousTokenManager() {
+	AnonTokens = NewAnonymousTokenManager(Cfg.AnonPoolSize, Cfg.AnonTokenTTL, Cfg.AnonRefreshBefore)
+	go AnonTokens.refill()
+
+	ticker := time.NewTicker(30 * time.Second)
+	go func() {
+		for range ticker.C {
+			AnonTokens.dropExpiring()
+			AnonTokens.refill()
+		}
+	}()
+}
+
+// 从 JWT 的 exp 字段解析过期时间，缺失时使用配置的 TTL
+func (m *AnonymousTokenManager) expiryOf(token string) time.Time {
+	if payload, err := DecodeJWTPayload(token); err == nil && payload != nil && payload.Exp > 0 {
+		return time.Unix(payload.Exp, 0)
+	}
+	return time.Now().Add(m.ttl)
+}
+
+func (m *AnonymousTokenManager) fetch(ctx context.Context) (*anonymousToken, error) {
+	token, err := GetAnonymousToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &anonymousToken{token: token, expiresAt: m.expiryOf(token)}, nil
+}
+
+// Get 轮询返回一个仍然有效的缓存 token，池为空时同步获取
+func (m *AnonymousTokenManager) Get(ctx context.Context) (string, error) {
+	m.mu.Lock()
+	now := time.Now()
+	for i := 0; i < len(m.tokens); i++ {
+		t := m.tokens[(m.next+i)%len(m.tokens)]
+		if now.Before(t.expiresAt) {
+			m.next = (m.next + i + 1) % len(m.tokens)
+			m.mu.Unlock()
+			return t.token, nil
+		}
+	}
+	m.mu.Unlock()
+
+	t, err := m.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	m.add(t)
+	go m.refill()
+	return t.token, nil
+}
+
+func (m *AnonymousTokenManager) add(t *anonymousToken) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.tokens) < m.size {
+		m.tokens = append(m.tokens, t)
+	}
+}
+
+// Invalidate 在上游拒绝 token 后将其移出缓存
+func (m *AnonymousTokenManager) Invalidate(token string) {
+	m.mu.Lock()
+	for i, t := range m.tokens {
+		if t.token == token {
+			m.tokens = append(m.tokens[:i], m.tokens[i+1:]...)
+			LogInfo("[Anonymous] Dropped rejected token, %d cached", len(m.tokens))
+			break
+		}
+	}
+	m.mu.Unlock()
+	go m.refill()
+}
+
+// dropExpiring 移除即将过期的 token
+func (m *AnonymousTokenManager) dropExpiring() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deadline := time.Now().Add(m.refreshBefore)
+	var kept []*anonymousToken
+	for _, t := range m.tokens {
+		if t.expiresAt.After(deadline) {
+			kept = append(kept, t)
+		}
+	}
+	if dropped := len(m.tokens) - len(kept); dropped > 0 {
+		LogDebug("[Anonymous] Dropped %d expiring tokens", dropped)
+	}
+	m.tokens = kept
+}
+
+// refill 补足预热池，同一时间只有一个补充任务
+func (m *AnonymousTokenManager) refill() {
+	m.mu.Lock()
+	if m.refilling {
+		m.mu.Unlock()
+		return
+	}
+	m.refilling = true
+	missing := m.size - len(m.tokens)
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		m.refilling = false
+		m.mu.Unlock()
+	}()
+
+	for i := 0; i < missing; i++ {
+		t, err := m.fetch(context.Background())
+		if err != nil {
+			LogError("[Anonymous] Failed to refresh token: %v", err)
+			return
+		}
+		m.add(t)
+	}
+	if missing > 0 {
+		LogDebug("[Anonymous] Token pool refilled with %d tokens", missing)
+	}
+}
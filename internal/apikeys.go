@@ -0,0 +1,393 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	APIKeyTargetPool      = "pool"
+	APIKeyTargetToken     = "token"
+	APIKeyTargetAnonymous = "anonymous"
+
+	apiKeyPrefix = "zp-"
+)
+
+// APIKey 是代理签发的 API key，文件中只保存 key 的 SHA-256
+type APIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Hash      string     `json:"hash"`
+	Prefix    string     `json:"prefix"`
+	Target    string     `json:"target"`
+	Token     string     `json:"token,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	Limits    *KeyLimits `json:"limits,omitempty"`
+	Usage     KeyUsage   `json:"usage"`
+}
+
+// APIKeyInfo 是管理接口返回的 key 信息，不包含 key 本身和上游 token
+type APIKeyInfo struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	Target    string     `json:"target"`
+	State     string     `json:"state"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	Limits    *KeyLimits `json:"limits,omitempty"`
+	UsedToday int        `json:"used_tokens_today"`
+}
+
+type APIKeyStore struct {
+	mu   sync.Mutex
+	path string
+	keys []*APIKey
+
+	// 限流状态，只保存在内存中
+	requests map[string][]time.Time
+	streams  map[string]int
+	// 用量有变化尚未写入文件
+	dirty bool
+}
+
+var APIKeys *APIKeyStore
+
+// authError 表示客户端 key 无效，处理函数据此返回 401
+type authError string
+
+func (e authError) Error() string {
+	return string(e)
+}
+
+// InitAPIKeys 从 API_KEYS_FILE 加载代理签发的 key，文件不存在时在首次创建 key 时生成
+func InitAPIKeys() {
+	defer logAuthPolicy()
+	if Cfg.APIKeysFile == "" {
+		return
+	}
+	store, err := LoadAPIKeyStore(Cfg.APIKeysFile)
+	if err != nil {
+		LogError("Failed to load API keys: %v", err)
+		return
+	}
+	APIKeys = store
+	store.startUsageFlusher(30 * time.Second)
+	LogInfo("API keys loaded: %d keys", len(store.keys))
+}
+
+// logAuthPolicy 输出实际生效的鉴权策略
+func logAuthPolicy() {
+	LogInfo("Auth policy: issued_keys=%v, anonymous(free)=%v, anthropic_key_as_free=%v, raw_tokens=%v, proxy_api_key=%v",
+		APIKeys != nil, Cfg.AllowAnonymous, Cfg.AnthropicKeyFree, Cfg.AllowRawTokens, Pool != nil && proxyAPIKeyEnabled())
+}
+
+func LoadAPIKeyStore(path string) (*APIKeyStore, error) {
+	store := &APIKeyStore{
+		path:     path,
+		requests: make(map[string][]time.Time),
+		streams:  make(map[string]int),
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.keys); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// save 先写临时文件再替换，避免写入中断导致文件损坏，调用方需持有锁
+func (s *APIKeyStore) save() error {
+	data, err := json.MarshalIndent(s.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func validateAPIKeyTarget(target, token string) error {
+	switch target {
+	case APIKeyTargetPool, APIKeyTargetAnonymous:
+		return nil
+	case APIKeyTargetToken:
+		if token == "" {
+			return fmt.Errorf("token is required for target %q", target)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported target %q", target)
+}
+
+// Create 签发新 key，返回的明文 key 只在此时可见
+func (s *APIKeyStore) Create(name, target, token string, expiresAt *time.Time, limits *KeyLimits) (*APIKey, string, error) {
+	if err := validateAPIKeyTarget(target, token); err != nil {
+		return nil, "", err
+	}
+	if target != APIKeyTargetToken {
+		token = ""
+	}
+
+	secret := apiKeyPrefix + randomHex(24)
+	key := &APIKey{
+		ID:        "key_" + randomHex(8),
+		Name:      name,
+		Hash:      hashAPIKey(secret),
+		Prefix:    secret[:len(apiKeyPrefix)+6],
+		Target:    target,
+		Token:     token,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+		Limits:    limits,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, key)
+	if err := s.save(); err != nil {
+		s.keys = s.keys[:len(s.keys)-1]
+		return nil, "", err
+	}
+	return key, secret, nil
+}
+
+// Revoke 吊销 key，已吊销的 key 保留在文件中以便审计
+func (s *APIKeyStore) Revoke(id string) (*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.keys {
+		if k.ID != id {
+			continue
+		}
+		if k.RevokedAt == nil {
+			now := time.Now().UTC()
+			k.RevokedAt = &now
+			if err := s.save(); err != nil {
+				k.RevokedAt = nil
+				return nil, err
+			}
+		}
+		return k, nil
+	}
+	return nil, nil
+}
+
+// Lookup 查找 key，未签发时返回 nil，已吊销或过期时返回 authError
+func (s *APIKeyStore) Lookup(secret string) (*APIKey, error) {
+	if !strings.HasPrefix(secret, apiKeyPrefix) {
+		return nil, nil
+	}
+	hash := hashAPIKey(secret)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.keys {
+		if k.Hash != hash {
+			continue
+		}
+		if k.RevokedAt != nil {
+			return nil, authError("API key has been revoked")
+		}
+		if k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt) {
+			return nil, authError("API key has expired")
+		}
+		return k, nil
+	}
+	return nil, nil
+}
+
+func (s *APIKeyStore) Info(k *APIKey) APIKeyInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return k.info()
+}
+
+func (s *APIKeyStore) List() []APIKeyInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := []APIKeyInfo{}
+	for _, k := range s.keys {
+		result = append(result, k.info())
+	}
+	return result
+}
+
+// info 生成管理接口展示的信息，调用方需持有锁
+func (k *APIKey) info() APIKeyInfo {
+	state := "active"
+	if k.RevokedAt != nil {
+		state = "revoked"
+	} else if k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt) {
+		state = "expired"
+	}
+	return APIKeyInfo{
+		ID:        k.ID,
+		Name:      k.Name,
+		Prefix:    k.Prefix,
+		Target:    k.Target,
+		State:     state,
+		CreatedAt: k.CreatedAt,
+		ExpiresAt: k.ExpiresAt,
+		RevokedAt: k.RevokedAt,
+		Limits:    k.Limits,
+		UsedToday: k.todayTokens(time.Now()),
+	}
+}
+
+type createAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Target    string     `json:"target"`
+	Token     string     `json:"token,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	ExpiresIn string     `json:"expires_in,omitempty"` // 如 "720h"
+	Limits    *KeyLimits `json:"limits,omitempty"`
+}
+
+type updateAPIKeyRequest struct {
+	Limits *KeyLimits `json:"limits"`
+}
+
+// HandleAdminKeys 列出或签发 API key
+// GET /admin/keys 列出，POST /admin/keys 签发，
+// PATCH /admin/keys/{id} 修改限额，DELETE /admin/keys/{id} 吊销
+func HandleAdminKeys(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(w, r) {
+		return
+	}
+	if APIKeys == nil {
+		writeAdminError(w, http.StatusNotFound, "API_KEYS_FILE is not configured")
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/keys"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+			"object": "list",
+			"data":   APIKeys.List(),
+		})
+	case id == "" && r.Method == http.MethodPost:
+		handleCreateAPIKey(w, r)
+	case id != "" && r.Method == http.MethodPatch:
+		var req updateAPIKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAdminError(w, http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+		key, err := APIKeys.SetLimits(id, req.Limits)
+		if err != nil {
+			LogError("Failed to update API key: %v", err)
+			writeAdminError(w, http.StatusInternalServerError, "Failed to save API keys")
+			return
+		}
+		if key == nil {
+			writeAdminError(w, http.StatusNotFound, "API key not found")
+			return
+		}
+		LogInfo("[Keys] Updated limits of API key %s (%s)", key.ID, key.Name)
+		writeAdminJSON(w, http.StatusOK, APIKeys.Info(key))
+	case id != "" && r.Method == http.MethodDelete:
+		key, err := APIKeys.Revoke(id)
+		if err != nil {
+			LogError("Failed to revoke API key: %v", err)
+			writeAdminError(w, http.StatusInternalServerError, "Failed to save API keys")
+			return
+		}
+		if key == nil {
+			writeAdminError(w, http.StatusNotFound, "API key not found")
+			return
+		}
+		LogInfo("[Keys] Revoked API key %s (%s)", key.ID, key.Name)
+		writeAdminJSON(w, http.StatusOK, APIKeys.Info(key))
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req createAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if req.Target == "" {
+		req.Target = APIKeyTargetPool
+	}
+	if err := validateAPIKeyTarget(req.Target, req.Token); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Target == APIKeyTargetPool && Pool == nil {
+		writeAdminError(w, http.StatusBadRequest, "Token pool is not configured")
+		return
+	}
+	expiresAt := req.ExpiresAt
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			writeAdminError(w, http.StatusBadRequest, "Invalid expires_in")
+			return
+		}
+		t := time.Now().UTC().Add(d)
+		expiresAt = &t
+	}
+
+	key, secret, err := APIKeys.Create(req.Name, req.Target, req.Token, expiresAt, req.Limits)
+	if err != nil {
+		LogError("Failed to save API keys: %v", err)
+		writeAdminError(w, http.StatusInternalServerError, "Failed to save API keys")
+		return
+	}
+	LogInfo("[Keys] Created API key %s (%s) -> %s", key.ID, key.Name, key.Target)
+
+	writeAdminJSON(w, http.StatusCreated, map[string]interface{}{
+		"key":  secret,
+		"info": APIKeys.Info(key),
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJSON(w, status, map[string]interface{}{
+		"error": map[string]string{"message": message},
+	})
+}
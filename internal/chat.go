@@ -1,9 +1,10 @@
 package internal
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -33,10 +34,13 @@ func extractAllImageURLs(messages []Message) []string {
 	return allImageURLs
 }
 
-func makeUpstreamRequest(token string, messages []Message, model string) (*http.Response, string, error) {
+var errInvalidToken = errors.New("invalid token")
+
+// makeUpstreamRequest 发送一次上游请求，images 为 nil 时不复用已上传的图片
+func makeUpstreamRequest(ctx context.Context, token string, messages []Message, model string, images *imageUploads) (*http.Response, string, error) {
 	payload, err := DecodeJWTPayload(token)
 	if err != nil || payload == nil {
-		return nil, "", fmt.Errorf("invalid token")
+		return nil, "", errInvalidToken
 	}
 
 	userID := payload.ID
@@ -45,37 +49,38 @@ func makeUpstreamRequest(token string, messages []Message, model string) (*http.
 	requestID := uuid.New().String()
 	userMsgID := uuid.New().String()
 
-	targetModel := GetTargetModel(model)
+	resolved := GetModelRegistry().Resolve(model)
+	targetModel := resolved.Upstream
 	latestUserContent := extractLatestUserContent(messages)
 	imageURLs := extractAllImageURLs(messages)
 
-	signature := GenerateSignature(userID, requestID, latestUserContent, timestamp)
-
-	url := fmt.Sprintf("https://chat.z.ai/api/v2/chat/completions?timestamp=%d&requestId=%s&user_id=%s&version=0.0.1&platform=web&token=%s&current_url=%s&pathname=%s&signature_timestamp=%d",
-		timestamp, requestID, userID, token,
-		fmt.Sprintf("https://chat.z.ai/c/%s", chatID),
-		fmt.Sprintf("/c/%s", chatID),
-		timestamp)
-
-	enableThinking := IsThinkingModel(model)
-	autoWebSearch := IsSearchModel(model)
-	if targetModel == "glm-4.5v" || targetModel == "glm-4.6v" {
-		autoWebSearch = false
+	signParams := SignParams{
+		UserID:    userID,
+		RequestID: requestID,
+		ChatID:    chatID,
+		Token:     token,
+		Content:   latestUserContent,
+		Timestamp: timestamp,
 	}
+	signer := GetSigner()
+	signature := signer.Sign(signParams)
+	url := upstreamURL("/api/v2/chat/completions") + "?" + signer.QueryString(signParams)
 
-	var mcpServers []string
-	if targetModel == "glm-4.6v" {
-		mcpServers = []string{"vlm-image-search", "vlm-image-recognition", "vlm-image-processing"}
+	if len(imageURLs) > 0 && resolved.Definition != nil && !resolved.Definition.Capabilities.Vision {
+		LogWarn("Model %s is not marked as supporting images", model)
 	}
 
 	urlToFileID := make(map[string]string)
 	var filesData []map[string]interface{}
 	if len(imageURLs) > 0 {
-		files, _ := UploadImages(token, imageURLs)
-		for i, f := range files {
-			if i < len(imageURLs) {
-				urlToFileID[imageURLs[i]] = f.ID
+		if images == nil {
+			images = newImageUploads()
+		}
+		for i, f := range images.Upload(ctx, token, imageURLs) {
+			if f == nil {
+				continue
 			}
+			urlToFileID[imageURLs[i]] = f.ID
 			filesData = append(filesData, map[string]interface{}{
 				"type":            f.Type,
 				"file":            f.File,
@@ -103,18 +108,12 @@ func makeUpstreamRequest(token string, messages []Message, model string) (*http.
 		"messages":         upstreamMessages,
 		"signature_prompt": latestUserContent,
 		"params":           map[string]interface{}{},
-		"features": map[string]interface{}{
-			"image_generation": false,
-			"web_search":       false,
-			"auto_web_search":  autoWebSearch,
-			"preview_mode":     true,
-			"enable_thinking":  enableThinking,
-		},
-		"chat_id": chatID,
-		"id":      uuid.New().String(),
+		"features":         resolved.features(),
+		"chat_id":          chatID,
+		"id":               uuid.New().String(),
 	}
 
-	if len(mcpServers) > 0 {
+	if mcpServers := resolved.mcpServers(); len(mcpServers) > 0 {
 		body["mcp_servers"] = mcpServers
 	}
 
@@ -125,7 +124,7 @@ func makeUpstreamRequest(token string, messages []Message, model string) (*http.
 
 	bodyBytes, _ := json.Marshal(body)
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(bodyBytes))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(bodyBytes))
 	if err != nil {
 		return nil, "", err
 	}
@@ -135,12 +134,11 @@ func makeUpstreamRequest(token string, messages []Message, model string) (*http.
 	req.Header.Set("X-Signature", signature)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Origin", "https://chat.z.ai")
-	req.Header.Set("Referer", fmt.Sprintf("https://chat.z.ai/c/%s", uuid.New().String()))
+	req.Header.Set("Origin", Cfg.UpstreamBaseURL)
+	req.Header.Set("Referer", upstreamURL("/c/"+uuid.New().String()))
 	req.Header.Set("User-Agent", uarand.GetRandom())
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := doUpstream(ctx, req)
 	if err != nil {
 		return nil, "", err
 	}
@@ -148,145 +146,90 @@ func makeUpstreamRequest(token string, messages []Message, model string) (*http.
 	return resp, targetModel, nil
 }
 
-type UpstreamData struct {
-	Type string `json:"type"`
-	Data struct {
-		DeltaContent string `json:"delta_content"`
-		EditContent  string `json:"edit_content"`
-		Phase        string `json:"phase"`
-		Done         bool   `json:"done"`
-	} `json:"data"`
-}
-
-func (u *UpstreamData) GetEditContent() string {
-	editContent := u.Data.EditContent
-	if editContent == "" {
-		return ""
-	}
-
-	if len(editContent) > 0 && editContent[0] == '"' {
-		var unescaped string
-		if err := json.Unmarshal([]byte(editContent), &unescaped); err == nil {
-			LogDebug("[GetEditContent] Unescaped edit_content from JSON string")
-			return unescaped
-		}
-	}
-
-	return editContent
-}
-
-type ThinkingFilter struct {
-	hasSeenFirstThinking bool
-	buffer               string
-	lastOutputChunk      string
-	lastPhase            string
-	thinkingRoundCount   int
-}
-
-func (f *ThinkingFilter) ProcessThinking(deltaContent string) string {
-	if !f.hasSeenFirstThinking {
-		f.hasSeenFirstThinking = true
-		if idx := strings.Index(deltaContent, "> "); idx != -1 {
-			deltaContent = deltaContent[idx+2:]
-		} else {
-			return ""
-		}
+func HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	apiKey := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if apiKey == "" {
+		writeOpenAIError(w, http.StatusUnauthorized, "Missing API key", "invalid_request_error", "invalid_api_key")
+		return
 	}
 
-	content := f.buffer + deltaContent
-	f.buffer = ""
-
-	content = strings.ReplaceAll(content, "\n> ", "\n")
-
-	if strings.HasSuffix(content, "\n>") {
-		f.buffer = "\n>"
-		return content[:len(content)-2]
-	}
-	if strings.HasSuffix(content, "\n") {
-		f.buffer = "\n"
-		return content[:len(content)-1]
+	lease, err := resolveToken(r.Context(), apiKey)
+	if authErr, ok := err.(authError); ok {
+		LogWarn("Rejected API key %s: %v", maskToken(apiKey), authErr)
+		writeOpenAIError(w, http.StatusUnauthorized, authErr.Error(), "invalid_request_error", "invalid_api_key")
+		return
 	}
-
-	return content
-}
-
-func (f *ThinkingFilter) Flush() string {
-	result := f.buffer
-	f.buffer = ""
-	return result
-}
-
-func (f *ThinkingFilter) ExtractCompleteThinking(editContent string) string {
-	startIdx := strings.Index(editContent, "> ")
-	if startIdx == -1 {
-		return ""
+	if err == errPoolExhausted {
+		LogError("Token pool exhausted")
+		writeOpenAIError(w, http.StatusServiceUnavailable, "No available upstream token", "server_error", "")
+		return
 	}
-	startIdx += 2
-
-	endIdx := strings.Index(editContent, "\n</details>")
-	if endIdx == -1 {
-		return ""
+	if err != nil {
+		LogError("Failed to get upstream token: %v", err)
+		writeOpenAIError(w, http.StatusInternalServerError, "Failed to get upstream token", "server_error", "")
+		return
 	}
+	defer lease.Release()
 
-	content := editContent[startIdx:endIdx]
-	content = strings.ReplaceAll(content, "\n> ", "\n")
-	return content
-}
-
-func (f *ThinkingFilter) ExtractIncrementalThinking(editContent string) string {
-	completeThinking := f.ExtractCompleteThinking(editContent)
-	if completeThinking == "" {
-		return ""
+	var req ChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
 	}
 
-	if f.lastOutputChunk == "" {
-		return completeThinking
+	if err := lease.CheckLimits(w, req.Stream); err != nil {
+		LogWarn("Rate limited API key %s: %v", maskToken(apiKey), err)
+		writeOpenAIError(w, http.StatusTooManyRequests, err.Error(), err.(*rateLimitError).kind, "rate_limit_exceeded")
+		return
 	}
 
-	idx := strings.Index(completeThinking, f.lastOutputChunk)
-	if idx == -1 {
-		return completeThinking
+	if req.Model == "" {
+		req.Model = "GLM-4.6"
 	}
 
-	incrementalPart := completeThinking[idx+len(f.lastOutputChunk):]
-	return incrementalPart
-}
-
-func (f *ThinkingFilter) ResetForNewRound() {
-	f.lastOutputChunk = ""
-	f.hasSeenFirstThinking = false
-}
-
-func HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
-	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-	if token == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	messages := req.Messages
+	opts := &responseOptions{thinkingEnabled: IsThinkingModel(req.Model)}
+	if err := validateToolChoice(req.Tools, req.ToolChoice); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, err.Error(), "invalid_request_error", "")
 		return
 	}
-
-	if token == "free" {
-		anonymousToken, err := GetAnonymousToken()
-		if err != nil {
-			LogError("Failed to get anonymous token: %v", err)
-			http.Error(w, "Failed to get anonymous token", http.StatusInternalServerError)
-			return
-		}
-		token = anonymousToken
+	if len(req.Tools) > 0 || hasToolMessages(messages) {
+		messages = applyToolEmulation(messages, req.Tools, req.ToolChoice)
+		enabled, _, _ := parseToolChoice(req.ToolChoice)
+		opts.toolsEnabled = enabled && len(req.Tools) > 0
 	}
 
-	var req ChatRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	jsonOutput, err := newJSONOutputSpec(req.ResponseFormat)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, err.Error(), "invalid_request_error", "")
 		return
 	}
+	if jsonOutput != nil {
+		messages = jsonOutput.applyPrompt(messages)
+		opts.jsonOutput = jsonOutput
+	}
 
-	if req.Model == "" {
-		req.Model = "GLM-4.6"
+	opts.promptTokens = EstimateMessagesTokens(messages)
+	opts.includeUsage = req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+	opts.maxTokens = req.MaxCompletionTokens
+	if opts.maxTokens == 0 {
+		opts.maxTokens = req.MaxTokens
 	}
+	opts.stopSequences = parseStopField(req.Stop)
 
-	resp, modelName, err := makeUpstreamRequest(token, req.Messages, req.Model)
+	// 重试、后备模型和结构化输出重试共用已上传的图片
+	images := newImageUploads()
+	resp, modelName, usedModel, err := sendWithFallback(r.Context(), lease, messages, req.Model, images)
 	if err != nil {
+		if isClientGone(r.Context(), err) {
+			LogDebug("Client disconnected before upstream responded")
+			return
+		}
 		LogError("Upstream request failed: %v", err)
+		if err == errUpstreamTimeout {
+			writeOpenAIError(w, http.StatusGatewayTimeout, "Upstream timed out", "server_error", "upstream_timeout")
+			return
+		}
 		http.Error(w, "Upstream error", http.StatusBadGateway)
 		return
 	}
@@ -302,506 +245,292 @@ func HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Upstream error", resp.StatusCode)
 		return
 	}
+	// 上游请求失败时不计入 key 的用量
+	defer func() { lease.RecordUsage(opts.promptTokens + opts.completionTokens) }()
+
+	w.Header().Set("X-Model-Used", usedModel)
+	if usedModel != req.Model {
+		opts.thinkingEnabled = IsThinkingModel(usedModel)
+	}
 
 	completionID := fmt.Sprintf("chatcmpl-%s", uuid.New().String()[:29])
+	body := recordUpstream(resp.Body, completionID, RecordingMeta{
+		Model:       usedModel,
+		TargetModel: modelName,
+		Thinking:    opts.thinkingEnabled,
+		Tools:       opts.toolsEnabled,
+	})
+	defer body.Close()
 
 	if req.Stream {
-		handleStreamResponse(w, resp.Body, completionID, modelName)
-	} else {
-		handleNonStreamResponse(w, resp.Body, completionID, modelName)
+		handleStreamResponse(w, body, completionID, modelName, opts)
+		return
 	}
-}
-
-func handleStreamResponse(w http.ResponseWriter, body io.ReadCloser, completionID, modelName string) {
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+	if jsonOutput == nil {
+		handleNonStreamResponse(w, body, completionID, modelName, opts)
 		return
 	}
 
-	scanner := bufio.NewScanner(body)
-	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
-	hasContent := false
-	searchRefFilter := NewSearchRefFilter()
-	thinkingFilter := &ThinkingFilter{}
-	pendingSourcesMarkdown := ""
-	pendingImageSearchMarkdown := ""
-	totalContentOutputLength := 0 // 记录已输出的 content 字符长度
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		LogDebug("[Upstream] %s", line)
-
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-
-		payload := strings.TrimPrefix(line, "data: ")
-		if payload == "[DONE]" {
-			break
-		}
-
-		var upstream UpstreamData
-		if err := json.Unmarshal([]byte(payload), &upstream); err != nil {
-			continue
-		}
-
-		if upstream.Data.Phase == "done" {
-			break
-		}
-
-		if upstream.Data.Phase == "thinking" && upstream.Data.DeltaContent != "" {
-			isNewThinkingRound := false
-			if thinkingFilter.lastPhase != "" && thinkingFilter.lastPhase != "thinking" {
-				thinkingFilter.ResetForNewRound()
-				thinkingFilter.thinkingRoundCount++
-				isNewThinkingRound = true
-			}
-			thinkingFilter.lastPhase = "thinking"
-
-			reasoningContent := thinkingFilter.ProcessThinking(upstream.Data.DeltaContent)
-
-			if isNewThinkingRound && thinkingFilter.thinkingRoundCount > 1 && reasoningContent != "" {
-				reasoningContent = "\n\n" + reasoningContent
-			}
-
-			if reasoningContent != "" {
-				thinkingFilter.lastOutputChunk = reasoningContent
-				reasoningContent = searchRefFilter.Process(reasoningContent)
-
-				if reasoningContent != "" {
-					hasContent = true
-					chunk := ChatCompletionChunk{
-						ID:      completionID,
-						Object:  "chat.completion.chunk",
-						Created: time.Now().Unix(),
-						Model:   modelName,
-						Choices: []Choice{{
-							Index:        0,
-							Delta:        Delta{ReasoningContent: reasoningContent},
-							FinishReason: nil,
-						}},
-					}
-					data, _ := json.Marshal(chunk)
-					fmt.Fprintf(w, "data: %s\n\n", data)
-					flusher.Flush()
-				}
-			}
-			continue
-		}
-
-		if upstream.Data.Phase != "" {
-			thinkingFilter.lastPhase = upstream.Data.Phase
-		}
-
-		editContent := upstream.GetEditContent()
-		if editContent != "" && IsSearchResultContent(editContent) {
-			if results := ParseSearchResults(editContent); len(results) > 0 {
-				searchRefFilter.AddSearchResults(results)
-				pendingSourcesMarkdown = searchRefFilter.GetSearchResultsMarkdown()
-			}
-			continue
-		}
-		if editContent != "" && strings.Contains(editContent, `"search_image"`) {
-			textBeforeBlock := ExtractTextBeforeGlmBlock(editContent)
-			if textBeforeBlock != "" {
-				textBeforeBlock = searchRefFilter.Process(textBeforeBlock)
-				if textBeforeBlock != "" {
-					hasContent = true
-					chunk := ChatCompletionChunk{
-						ID:      completionID,
-						Object:  "chat.completion.chunk",
-						Created: time.Now().Unix(),
-						Model:   modelName,
-						Choices: []Choice{{
-							Index:        0,
-							Delta:        Delta{Content: textBeforeBlock},
-							FinishReason: nil,
-						}},
-					}
-					data, _ := json.Marshal(chunk)
-					fmt.Fprintf(w, "data: %s\n\n", data)
-					flusher.Flush()
-				}
-			}
-			if results := ParseImageSearchResults(editContent); len(results) > 0 {
-				pendingImageSearchMarkdown = FormatImageSearchResults(results)
-			}
-			continue
-		}
-		if editContent != "" && strings.Contains(editContent, `"mcp"`) {
-			textBeforeBlock := ExtractTextBeforeGlmBlock(editContent)
-			if textBeforeBlock != "" {
-				textBeforeBlock = searchRefFilter.Process(textBeforeBlock)
-				if textBeforeBlock != "" {
-					hasContent = true
-					chunk := ChatCompletionChunk{
-						ID:      completionID,
-						Object:  "chat.completion.chunk",
-						Created: time.Now().Unix(),
-						Model:   modelName,
-						Choices: []Choice{{
-							Index:        0,
-							Delta:        Delta{Content: textBeforeBlock},
-							FinishReason: nil,
-						}},
-					}
-					data, _ := json.Marshal(chunk)
-					fmt.Fprintf(w, "data: %s\n\n", data)
-					flusher.Flush()
-				}
-			}
-			continue
-		}
-		if editContent != "" && IsSearchToolCall(editContent, upstream.Data.Phase) {
-			continue
-		}
-
-		if pendingSourcesMarkdown != "" {
-			hasContent = true
-			chunk := ChatCompletionChunk{
-				ID:      completionID,
-				Object:  "chat.completion.chunk",
-				Created: time.Now().Unix(),
-				Model:   modelName,
-				Choices: []Choice{{
-					Index:        0,
-					Delta:        Delta{Content: pendingSourcesMarkdown},
-					FinishReason: nil,
-				}},
-			}
-			data, _ := json.Marshal(chunk)
-			fmt.Fprintf(w, "data: %s\n\n", data)
-			flusher.Flush()
-			pendingSourcesMarkdown = ""
-		}
-		if pendingImageSearchMarkdown != "" {
-			hasContent = true
-			chunk := ChatCompletionChunk{
-				ID:      completionID,
-				Object:  "chat.completion.chunk",
-				Created: time.Now().Unix(),
-				Model:   modelName,
-				Choices: []Choice{{
-					Index:        0,
-					Delta:        Delta{Content: pendingImageSearchMarkdown},
-					FinishReason: nil,
-				}},
-			}
-			data, _ := json.Marshal(chunk)
-			fmt.Fprintf(w, "data: %s\n\n", data)
-			flusher.Flush()
-			pendingImageSearchMarkdown = ""
-		}
-
-		content := ""
-		reasoningContent := ""
-
-		if thinkingRemaining := thinkingFilter.Flush(); thinkingRemaining != "" {
-			thinkingFilter.lastOutputChunk = thinkingRemaining
-			processedRemaining := searchRefFilter.Process(thinkingRemaining)
-			if processedRemaining != "" {
-				hasContent = true
-				chunk := ChatCompletionChunk{
-					ID:      completionID,
-					Object:  "chat.completion.chunk",
-					Created: time.Now().Unix(),
-					Model:   modelName,
-					Choices: []Choice{{
-						Index:        0,
-						Delta:        Delta{ReasoningContent: processedRemaining},
-						FinishReason: nil,
-					}},
-				}
-				data, _ := json.Marshal(chunk)
-				fmt.Fprintf(w, "data: %s\n\n", data)
-				flusher.Flush()
-			}
-		}
-
-		if pendingSourcesMarkdown != "" && thinkingFilter.hasSeenFirstThinking {
-			hasContent = true
-			chunk := ChatCompletionChunk{
-				ID:      completionID,
-				Object:  "chat.completion.chunk",
-				Created: time.Now().Unix(),
-				Model:   modelName,
-				Choices: []Choice{{
-					Index:        0,
-					Delta:        Delta{ReasoningContent: pendingSourcesMarkdown},
-					FinishReason: nil,
-				}},
-			}
-			data, _ := json.Marshal(chunk)
-			fmt.Fprintf(w, "data: %s\n\n", data)
-			flusher.Flush()
-			pendingSourcesMarkdown = ""
-		}
-
-		if upstream.Data.Phase == "answer" && upstream.Data.DeltaContent != "" {
-			content = upstream.Data.DeltaContent
-		} else if upstream.Data.Phase == "answer" && editContent != "" {
-			if strings.Contains(editContent, "</details>") {
-				reasoningContent = thinkingFilter.ExtractIncrementalThinking(editContent)
-
-				if idx := strings.Index(editContent, "</details>"); idx != -1 {
-					afterDetails := editContent[idx+len("</details>"):]
-					if strings.HasPrefix(afterDetails, "\n") {
-						content = afterDetails[1:]
-					} else {
-						content = afterDetails
-					}
-					totalContentOutputLength = len([]rune(content))
-				}
-			}
-		} else if (upstream.Data.Phase == "other" || upstream.Data.Phase == "tool_call") && editContent != "" {
-			fullContent := editContent
-			fullContentRunes := []rune(fullContent)
-
-			if len(fullContentRunes) > totalContentOutputLength {
-				content = string(fullContentRunes[totalContentOutputLength:])
-				totalContentOutputLength = len(fullContentRunes)
-			} else {
-				content = fullContent
-			}
+	// 非流式结构化输出校验失败时重新请求上游
+	result := collectNonStreamResponse(body, opts)
+	if writeReadError(w, result.err) {
+		return
+	}
+	result = jsonOutput.enforce(result, messages, func(retryMessages []Message) (*nonStreamResult, error) {
+		retryResp, _, err := sendUpstream(r.Context(), lease, retryMessages, usedModel, images)
+		if err != nil {
+			return nil, err
 		}
-
-		if reasoningContent != "" {
-			reasoningContent = searchRefFilter.Process(reasoningContent) + searchRefFilter.Flush()
+		defer retryResp.Body.Close()
+		if retryResp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("upstream status %d", retryResp.StatusCode)
 		}
-		if reasoningContent != "" {
-			hasContent = true
-			chunk := ChatCompletionChunk{
-				ID:      completionID,
-				Object:  "chat.completion.chunk",
-				Created: time.Now().Unix(),
-				Model:   modelName,
-				Choices: []Choice{{
-					Index:        0,
-					Delta:        Delta{ReasoningContent: reasoningContent},
-					FinishReason: nil,
-				}},
-			}
-			data, _ := json.Marshal(chunk)
-			fmt.Fprintf(w, "data: %s\n\n", data)
-			flusher.Flush()
+		retryResult := collectNonStreamResponse(retryResp.Body, opts)
+		if retryResult.err != nil {
+			return nil, retryResult.err
 		}
+		return retryResult, nil
+	})
+	writeNonStreamResponse(w, completionID, modelName, result, opts)
+}
 
-		if content == "" {
-			continue
-		}
+// responseOptions 控制响应处理阶段的附加行为
+type responseOptions struct {
+	toolsEnabled    bool
+	thinkingEnabled bool
+	jsonOutput      *jsonOutputSpec
+	includeUsage    bool
+	promptTokens    int
+	maxTokens       int
+	stopSequences   []string
+	// 思考内容的 token 预算，0 表示不单独限制
+	reasoningBudget int
+	// 由响应处理函数回填，用于 key 的用量统计
+	completionTokens int
+}
 
-		content = searchRefFilter.Process(content)
-		if content == "" {
-			continue
-		}
+// writeOpenAIError 返回 OpenAI 格式的错误响应
+func writeOpenAIError(w http.ResponseWriter, status int, message, errType, code string) {
+	var codeValue interface{}
+	if code != "" {
+		codeValue = code
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    errType,
+			"param":   nil,
+			"code":    codeValue,
+		},
+	})
+}
 
-		hasContent = true
-		if upstream.Data.Phase == "answer" && upstream.Data.DeltaContent != "" {
-			totalContentOutputLength += len([]rune(content))
-		}
+// writeStreamError 在流式响应中以 OpenAI error 对象的形式通知客户端
+func writeStreamError(w http.ResponseWriter, flusher http.Flusher, message, errType, code string) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    errType,
+			"code":    code,
+		},
+	})
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	flusher.Flush()
+}
 
-		chunk := ChatCompletionChunk{
-			ID:      completionID,
-			Object:  "chat.completion.chunk",
-			Created: time.Now().Unix(),
-			Model:   modelName,
-			Choices: []Choice{{
-				Index:        0,
-				Delta:        Delta{Content: content},
-				FinishReason: nil,
-			}},
-		}
+func handleStreamResponse(w http.ResponseWriter, body io.ReadCloser, completionID, modelName string, opts *responseOptions) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
 
-		data, _ := json.Marshal(chunk)
-		fmt.Fprintf(w, "data: %s\n\n", data)
-		flusher.Flush()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
 	}
 
-	if err := scanner.Err(); err != nil {
-		LogError("[Upstream] scanner error: %v", err)
+	renderer := &openAIStreamRenderer{
+		w:            w,
+		flusher:      flusher,
+		completionID: completionID,
+		modelName:    modelName,
+		opts:         opts,
 	}
-
-	if remaining := searchRefFilter.Flush(); remaining != "" {
-		hasContent = true
-		chunk := ChatCompletionChunk{
-			ID:      completionID,
-			Object:  "chat.completion.chunk",
-			Created: time.Now().Unix(),
-			Model:   modelName,
-			Choices: []Choice{{
-				Index:        0,
-				Delta:        Delta{Content: remaining},
-				FinishReason: nil,
-			}},
-		}
-		data, _ := json.Marshal(chunk)
-		fmt.Fprintf(w, "data: %s\n\n", data)
-		flusher.Flush()
+	if opts.jsonOutput != nil {
+		renderer.fenceFilter = &JSONFenceFilter{}
 	}
+	newEventPipeline(renderer, opts).Run(body)
+}
 
-	if !hasContent {
-		LogError("Stream response 200 but no content received")
-	}
+// openAIStreamRenderer 将输出写成 OpenAI 的 chat.completion.chunk 流
+type openAIStreamRenderer struct {
+	w            http.ResponseWriter
+	flusher      http.Flusher
+	completionID string
+	modelName    string
+	opts         *responseOptions
+
+	fenceFilter      *JSONFenceFilter
+	jsonContent      strings.Builder
+	completionTokens TokenCounter
+	reasoningTokens  TokenCounter
+}
 
-	stopReason := "stop"
-	finalChunk := ChatCompletionChunk{
-		ID:      completionID,
+func (r *openAIStreamRenderer) writeChunk(choices []Choice, usage *Usage) {
+	chunk := ChatCompletionChunk{
+		ID:      r.completionID,
 		Object:  "chat.completion.chunk",
 		Created: time.Now().Unix(),
-		Model:   modelName,
-		Choices: []Choice{{
-			Index:        0,
-			Delta:        Delta{},
-			FinishReason: &stopReason,
-		}},
+		Model:   r.modelName,
+		Choices: choices,
+		Usage:   usage,
 	}
+	data, _ := json.Marshal(chunk)
+	fmt.Fprintf(r.w, "data: %s\n\n", data)
+	r.flusher.Flush()
+}
 
-	data, _ := json.Marshal(finalChunk)
-	fmt.Fprintf(w, "data: %s\n\n", data)
-	fmt.Fprintf(w, "data: [DONE]\n\n")
-	flusher.Flush()
+func (r *openAIStreamRenderer) writeDelta(delta Delta) {
+	r.completionTokens.Add(delta.Content)
+	r.reasoningTokens.Add(delta.ReasoningContent)
+	for _, call := range delta.ToolCalls {
+		r.completionTokens.Add(call.Function.Name + call.Function.Arguments)
+	}
+	r.writeChunk([]Choice{{Index: 0, Delta: delta}}, nil)
 }
 
-func handleNonStreamResponse(w http.ResponseWriter, body io.ReadCloser, completionID, modelName string) {
-	scanner := bufio.NewScanner(body)
-	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
-	var chunks []string
-	var reasoningChunks []string
-	thinkingFilter := &ThinkingFilter{}
-	searchRefFilter := NewSearchRefFilter()
-	hasThinking := false
-	pendingSourcesMarkdown := ""
-	pendingImageSearchMarkdown := ""
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
+func (r *openAIStreamRenderer) Reasoning(text string) {
+	r.writeDelta(Delta{ReasoningContent: text})
+}
 
-		payload := strings.TrimPrefix(line, "data: ")
-		if payload == "[DONE]" {
-			break
-		}
+func (r *openAIStreamRenderer) Text(text string) {
+	if r.fenceFilter != nil {
+		text = r.fenceFilter.Process(text)
+		r.jsonContent.WriteString(text)
+	}
+	if text != "" {
+		r.writeDelta(Delta{Content: text})
+	}
+}
 
-		var upstream UpstreamData
-		if err := json.Unmarshal([]byte(payload), &upstream); err != nil {
-			continue
-		}
+func (r *openAIStreamRenderer) ToolCall(call ToolCall) {
+	r.writeDelta(Delta{ToolCalls: []ToolCall{call}})
+}
+
+func (r *openAIStreamRenderer) Error(err error) {
+	failure := classifyReadError(err)
+	if failure == nil {
+		LogDebug("[Upstream] Stream ended: %v", err)
+		return
+	}
+	LogWarn("[Upstream] Stream failed: %v", err)
+	writeStreamError(r.w, r.flusher, failure.message, "server_error", failure.code)
+	// 使用单独的结束原因，客户端可据此重试而不是把不完整的回答当作结果
+	r.finish(finishError)
+}
 
-		if upstream.Data.Phase == "done" {
-			break
+func (r *openAIStreamRenderer) Finish(reason, stopSequence string) {
+	// 流式结构化输出只能在结束时校验
+	if r.fenceFilter != nil {
+		rest := r.fenceFilter.Flush()
+		r.jsonContent.WriteString(rest)
+		if rest != "" {
+			r.writeDelta(Delta{Content: rest})
+		}
+		if _, err := r.opts.jsonOutput.Validate(r.jsonContent.String()); err != nil {
+			LogWarn("[JSON] Stream output failed validation: %v", err)
+			writeStreamError(r.w, r.flusher, fmt.Sprintf("The model did not produce valid JSON: %v", err), "invalid_response_error", "json_validation_failed")
+			// 不能以 stop 结束，否则客户端会把无效的输出当作结果
+			r.finish(finishError)
+			return
 		}
+	}
 
-		if upstream.Data.Phase == "thinking" && upstream.Data.DeltaContent != "" {
-			if thinkingFilter.lastPhase != "" && thinkingFilter.lastPhase != "thinking" {
-				thinkingFilter.ResetForNewRound()
-				thinkingFilter.thinkingRoundCount++
-				if thinkingFilter.thinkingRoundCount > 1 {
-					reasoningChunks = append(reasoningChunks, "\n\n")
-				}
-			}
-			thinkingFilter.lastPhase = "thinking"
+	// OpenAI 没有单独的 stop_sequence 结束原因
+	if reason == limitReasonStopSequence {
+		reason = finishStop
+	}
+	r.finish(reason)
+}
 
-			hasThinking = true
-			reasoningContent := thinkingFilter.ProcessThinking(upstream.Data.DeltaContent)
-			if reasoningContent != "" {
-				thinkingFilter.lastOutputChunk = reasoningContent
-				reasoningChunks = append(reasoningChunks, reasoningContent)
-			}
-			continue
-		}
+// finish 发送带结束原因的最后一个 chunk、usage 和 [DONE]
+func (r *openAIStreamRenderer) finish(reason string) {
+	r.writeChunk([]Choice{{Index: 0, Delta: Delta{}, FinishReason: &reason}}, nil)
 
-		if upstream.Data.Phase != "" {
-			thinkingFilter.lastPhase = upstream.Data.Phase
-		}
+	reasoning := r.reasoningTokens.Count()
+	r.opts.completionTokens = r.completionTokens.Count() + reasoning
 
-		editContent := upstream.GetEditContent()
-		if editContent != "" && IsSearchResultContent(editContent) {
-			if results := ParseSearchResults(editContent); len(results) > 0 {
-				searchRefFilter.AddSearchResults(results)
-				pendingSourcesMarkdown = searchRefFilter.GetSearchResultsMarkdown()
-			}
-			continue
-		}
-		if editContent != "" && strings.Contains(editContent, `"search_image"`) {
-			textBeforeBlock := ExtractTextBeforeGlmBlock(editContent)
-			if textBeforeBlock != "" {
-				chunks = append(chunks, textBeforeBlock)
-			}
-			// 解析图片搜索结果
-			if results := ParseImageSearchResults(editContent); len(results) > 0 {
-				pendingImageSearchMarkdown = FormatImageSearchResults(results)
-			}
-			continue
-		}
-		if editContent != "" && strings.Contains(editContent, `"mcp"`) {
-			textBeforeBlock := ExtractTextBeforeGlmBlock(editContent)
-			if textBeforeBlock != "" {
-				chunks = append(chunks, textBeforeBlock)
-			}
-			continue
-		}
-		if editContent != "" && IsSearchToolCall(editContent, upstream.Data.Phase) {
-			continue
-		}
+	// stream_options.include_usage: 最后额外发送一个 choices 为空的 usage chunk
+	if r.opts.includeUsage {
+		r.writeChunk([]Choice{}, newUsage(r.opts.promptTokens, r.opts.completionTokens, reasoning))
+	}
 
-		if pendingSourcesMarkdown != "" {
-			if hasThinking {
-				reasoningChunks = append(reasoningChunks, pendingSourcesMarkdown)
-			} else {
-				chunks = append(chunks, pendingSourcesMarkdown)
-			}
-			pendingSourcesMarkdown = ""
-		}
-		if pendingImageSearchMarkdown != "" {
-			chunks = append(chunks, pendingImageSearchMarkdown)
-			pendingImageSearchMarkdown = ""
-		}
+	fmt.Fprintf(r.w, "data: [DONE]\n\n")
+	r.flusher.Flush()
+}
 
-		content := ""
-		if upstream.Data.Phase == "answer" && upstream.Data.DeltaContent != "" {
-			content = upstream.Data.DeltaContent
-		} else if upstream.Data.Phase == "answer" && editContent != "" {
-			if strings.Contains(editContent, "</details>") {
-				reasoningContent := thinkingFilter.ExtractIncrementalThinking(editContent)
-				if reasoningContent != "" {
-					reasoningChunks = append(reasoningChunks, reasoningContent)
-				}
-
-				if idx := strings.Index(editContent, "</details>"); idx != -1 {
-					afterDetails := editContent[idx+len("</details>"):]
-					if strings.HasPrefix(afterDetails, "\n") {
-						content = afterDetails[1:]
-					} else {
-						content = afterDetails
-					}
-				}
-			}
-		} else if (upstream.Data.Phase == "other" || upstream.Data.Phase == "tool_call") && editContent != "" {
-			content = editContent
-		}
+// nonStreamResult 是非流式响应汇总后的结果
+type nonStreamResult struct {
+	content   string
+	reasoning string
+	toolCalls []ToolCall
+	refusal   string
+	// 截断原因: "length" / "stop_sequence"
+	limitReason  string
+	stopSequence string
+	// 读取上游时的错误，如超时
+	err error
+}
 
-		if content != "" {
-			chunks = append(chunks, content)
-		}
+func (r *nonStreamResult) usage(promptTokens int) *Usage {
+	var completion TokenCounter
+	completion.Add(r.content)
+	completion.Add(r.refusal)
+	for _, call := range r.toolCalls {
+		completion.Add(call.Function.Name + call.Function.Arguments)
 	}
+	reasoning := EstimateTokens(r.reasoning)
+	return newUsage(promptTokens, completion.Count()+reasoning, reasoning)
+}
 
-	fullContent := strings.Join(chunks, "")
-	fullContent = searchRefFilter.Process(fullContent) + searchRefFilter.Flush()
-	fullReasoning := strings.Join(reasoningChunks, "")
-	fullReasoning = searchRefFilter.Process(fullReasoning) + searchRefFilter.Flush()
+func handleNonStreamResponse(w http.ResponseWriter, body io.ReadCloser, completionID, modelName string, opts *responseOptions) {
+	result := collectNonStreamResponse(body, opts)
+	if writeReadError(w, result.err) {
+		return
+	}
+	if opts.jsonOutput != nil {
+		result = opts.jsonOutput.enforce(result, nil, nil)
+	}
+	writeNonStreamResponse(w, completionID, modelName, result, opts)
+}
 
-	if fullContent == "" {
-		LogError("Non-stream response 200 but no content received")
+// writeReadError 在读取上游超时或事件过大时返回错误，客户端已断开时不写入响应
+func writeReadError(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return false
+	}
+	if failure := classifyReadError(err); failure != nil {
+		LogWarn("[Upstream] Non-stream response failed: %v", err)
+		writeOpenAIError(w, failure.status, failure.message, "server_error", failure.code)
+	} else {
+		LogDebug("[Upstream] Non-stream response aborted: %v", err)
 	}
+	return true
+}
+
+func collectNonStreamResponse(body io.ReadCloser, opts *responseOptions) *nonStreamResult {
+	return collectResponse(body, opts, false)
+}
 
+func writeNonStreamResponse(w http.ResponseWriter, completionID, modelName string, result *nonStreamResult, opts *responseOptions) {
 	stopReason := "stop"
+	if len(result.toolCalls) > 0 {
+		stopReason = "tool_calls"
+	} else if result.limitReason == limitReasonLength {
+		stopReason = "length"
+	}
 	response := ChatCompletionResponse{
 		ID:      completionID,
 		Object:  "chat.completion",
@@ -811,30 +540,25 @@ func handleNonStreamResponse(w http.ResponseWriter, body io.ReadCloser, completi
 			Index: 0,
 			Message: &MessageResp{
 				Role:             "assistant",
-				Content:          fullContent,
-				ReasoningContent: fullReasoning,
+				Content:          result.content,
+				ReasoningContent: result.reasoning,
+				ToolCalls:        result.toolCalls,
+				Refusal:          result.refusal,
 			},
 			FinishReason: &stopReason,
 		}},
+		Usage: result.usage(opts.promptTokens),
 	}
+	opts.completionTokens = response.Usage.CompletionTokens
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
 func HandleModels(w http.ResponseWriter, r *http.Request) {
-	var models []ModelInfo
-	for _, id := range ModelList {
-		models = append(models, ModelInfo{
-			ID:      id,
-			Object:  "model",
-			OwnedBy: "z.ai",
-		})
-	}
-
 	response := ModelsResponse{
 		Object: "list",
-		Data:   models,
+		Data:   GetModelRegistry().ListModels(),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1,11 +1,11 @@
 package internal
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"path"
 	"strings"
 
 	"github.com/google/uuid"
@@ -13,9 +13,14 @@ import (
 
 // Claude API 格式
 type ClaudeContent struct {
-	Type   string                 `json:"type"`
-	Text   string                 `json:"text,omitempty"`
-	Source map[string]interface{} `json:"source,omitempty"`
+	Type      string                 `json:"type"`
+	Text      string                 `json:"text,omitempty"`
+	Source    map[string]interface{} `json:"source,omitempty"`
+	ID        string                 `json:"id,omitempty"`
+	Name      string                 `json:"name,omitempty"`
+	Input     json.RawMessage        `json:"input,omitempty"`
+	Thinking  string                 `json:"thinking,omitempty"`
+	Signature string                 `json:"signature,omitempty"`
 }
 
 type ClaudeMessage struct {
@@ -23,14 +28,32 @@ type ClaudeMessage struct {
 	Content json.RawMessage `json:"content"`
 }
 
+type ClaudeTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema,omitempty"`
+}
+
+type ClaudeThinkingConfig struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
+}
+
 type ClaudeRequest struct {
-	Model     string          `json:"model"`
-	Messages  []ClaudeMessage `json:"messages"`
-	MaxTokens int             `json:"max_tokens"`
-	Stream    bool            `json:"stream,omitempty"`
-	System    json.RawMessage `json:"system,omitempty"`
+	Model         string                `json:"model"`
+	Messages      []ClaudeMessage       `json:"messages"`
+	MaxTokens     int                   `json:"max_tokens"`
+	Stream        bool                  `json:"stream,omitempty"`
+	System        json.RawMessage       `json:"system,omitempty"`
+	Tools         []ClaudeTool          `json:"tools,omitempty"`
+	ToolChoice    interface{}           `json:"tool_choice,omitempty"`
+	Thinking      *ClaudeThinkingConfig `json:"thinking,omitempty"`
+	StopSequences []string              `json:"stop_sequences,omitempty"`
 }
 
+// Claude thinking 块的签名占位符，上游不提供签名，客户端回传时会被忽略
+const claudeThinkingSignature = "zai-proxy-unsigned-thinking"
+
 type ClaudeStreamResponse struct {
 	Type  string                 `json:"type"`
 	Index int                    `json:"index,omitempty"`
@@ -38,12 +61,61 @@ type ClaudeStreamResponse struct {
 }
 
 type ClaudeResponse struct {
-	ID      string          `json:"id"`
-	Type    string          `json:"type"`
-	Role    string          `json:"role"`
-	Content []ClaudeContent `json:"content"`
-	Model   string          `json:"model"`
-	Usage   map[string]int  `json:"usage"`
+	ID           string          `json:"id"`
+	Type         string          `json:"type"`
+	Role         string          `json:"role"`
+	Content      []ClaudeContent `json:"content"`
+	Model        string          `json:"model"`
+	StopReason   string          `json:"stop_reason"`
+	StopSequence *string         `json:"stop_sequence"`
+	Usage        map[string]int  `json:"usage"`
+}
+
+// 转换 Claude 图片块为 OpenAI 格式的 image_url
+func convertClaudeImage(item map[string]interface{}) map[string]interface{} {
+	source, ok := item["source"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	var url string
+	if sourceType, _ := source["type"].(string); sourceType == "base64" {
+		mediaType, _ := source["media_type"].(string)
+		data, _ := source["data"].(string)
+		url = fmt.Sprintf("data:%s;base64,%s", mediaType, data)
+	} else if sourceType == "url" {
+		url, _ = source["url"].(string)
+	} else {
+		return nil
+	}
+	return map[string]interface{}{
+		"type": "image_url",
+		"image_url": map[string]interface{}{
+			"url": url,
+		},
+	}
+}
+
+// 提取 tool_result 的文本内容，content 可以是字符串或内容块数组
+func claudeToolResultText(item map[string]interface{}) string {
+	var text string
+	switch content := item["content"].(type) {
+	case string:
+		text = content
+	case []interface{}:
+		var parts []string
+		for _, c := range content {
+			if block, ok := c.(map[string]interface{}); ok {
+				if t, ok := block["text"].(string); ok {
+					parts = append(parts, t)
+				}
+			}
+		}
+		text = strings.Join(parts, "\n")
+	}
+	if isError, _ := item["is_error"].(bool); isError {
+		text = "Error: " + text
+	}
+	return text
 }
 
 // 转换 Claude 消息为内部格式
@@ -51,7 +123,9 @@ func convertClaudeMessages(claudeMessages []ClaudeMessage) []Message {
 	var messages []Message
 	for _, cm := range claudeMessages {
 		var content interface{}
-		
+		var toolCalls []ToolCall
+		var toolResults []Message
+
 		// 尝试解析为字符串
 		var textContent string
 		if err := json.Unmarshal(cm.Content, &textContent); err == nil {
@@ -63,54 +137,154 @@ func convertClaudeMessages(claudeMessages []ClaudeMessage) []Message {
 				var parts []interface{}
 				for _, item := range arrayContent {
 					itemType, _ := item["type"].(string)
-					if itemType == "text" {
+					switch itemType {
+					case "text":
 						parts = append(parts, map[string]interface{}{
 							"type": "text",
 							"text": item["text"],
 						})
-					} else if itemType == "image" {
-						if source, ok := item["source"].(map[string]interface{}); ok {
-							if sourceType, _ := source["type"].(string); sourceType == "base64" {
-								mediaType, _ := source["media_type"].(string)
-								data, _ := source["data"].(string)
-								url := fmt.Sprintf("data:%s;base64,%s", mediaType, data)
-								parts = append(parts, map[string]interface{}{
-									"type": "image_url",
-									"image_url": map[string]interface{}{
-										"url": url,
-									},
-								})
-							} else if sourceType == "url" {
-								url, _ := source["url"].(string)
-								parts = append(parts, map[string]interface{}{
-									"type": "image_url",
-									"image_url": map[string]interface{}{
-										"url": url,
-									},
-								})
-							}
+					case "image":
+						if part := convertClaudeImage(item); part != nil {
+							parts = append(parts, part)
 						}
+					case "tool_use":
+						id, _ := item["id"].(string)
+						name, _ := item["name"].(string)
+						input, _ := json.Marshal(item["input"])
+						toolCalls = append(toolCalls, ToolCall{
+							ID:   id,
+							Type: "function",
+							Function: ToolCallFunction{
+								Name:      name,
+								Arguments: string(input),
+							},
+						})
+					case "tool_result":
+						id, _ := item["tool_use_id"].(string)
+						toolResults = append(toolResults, Message{
+							Role:       "tool",
+							Content:    claudeToolResultText(item),
+							ToolCallID: id,
+						})
 					}
 				}
 				content = parts
 			}
 		}
-		
+
+		// 工具结果必须紧跟在对应的 assistant 调用之后
+		messages = append(messages, toolResults...)
+		if len(toolResults) > 0 && len(toolCalls) == 0 {
+			if parts, ok := content.([]interface{}); ok && len(parts) == 0 {
+				continue
+			}
+		}
+
 		messages = append(messages, Message{
-			Role:    cm.Role,
-			Content: content,
+			Role:      cm.Role,
+			Content:   content,
+			ToolCalls: toolCalls,
 		})
 	}
 	return messages
 }
 
-// 映射 Claude 模型到内部模型
+// 转换 Claude 工具定义为 OpenAI 格式
+func convertClaudeTools(claudeTools []ClaudeTool) []Tool {
+	var tools []Tool
+	for _, t := range claudeTools {
+		tools = append(tools, Tool{
+			Type: "function",
+			Function: ToolFunction{
+				Name:        t.Name,
+				Description: t.Description,
+				Parameters:  t.InputSchema,
+			},
+		})
+	}
+	return tools
+}
+
+// Claude 的 tool_use id 使用 toolu_ 前缀
+func claudeToolUseID(call ToolCall) string {
+	return "toolu_" + strings.TrimPrefix(call.ID, "call_")
+}
+
+// tool_use 的 input 必须是 JSON 对象
+func claudeToolInput(call ToolCall) json.RawMessage {
+	args := strings.TrimSpace(call.Function.Arguments)
+	if strings.HasPrefix(args, "{") && json.Valid([]byte(args)) {
+		return json.RawMessage(args)
+	}
+	return json.RawMessage("{}")
+}
+
+// ClaudeModelRule 将匹配 Pattern（不区分大小写的通配符）的 Claude 模型名映射到内部模型，
+// Model 可以带 -thinking / -search 标签
+type ClaudeModelRule struct {
+	Pattern string
+	Model   string
+}
+
+// 内置映射，追加在 CLAUDE_MODEL_MAP 之后，保证任何模型名都有结果
+var defaultClaudeModelMap = []ClaudeModelRule{
+	{Pattern: "*opus*", Model: "GLM-4.6"},
+	{Pattern: "*sonnet*", Model: "GLM-4.6"},
+	{Pattern: "*", Model: "GLM-4.5"},
+}
+
+// parseClaudeModelMap 解析 CLAUDE_MODEL_MAP，每项形如 *opus*=GLM-4.7-thinking
+func parseClaudeModelMap(items []string) []ClaudeModelRule {
+	var rules []ClaudeModelRule
+	for _, item := range items {
+		pattern, model, ok := strings.Cut(item, "=")
+		pattern, model = strings.TrimSpace(pattern), strings.TrimSpace(model)
+		if !ok || pattern == "" || model == "" {
+			LogWarn("Ignoring invalid CLAUDE_MODEL_MAP entry %q", item)
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			LogWarn("Ignoring invalid CLAUDE_MODEL_MAP pattern %q: %v", pattern, err)
+			continue
+		}
+		rules = append(rules, ClaudeModelRule{Pattern: pattern, Model: model})
+	}
+	return append(rules, defaultClaudeModelMap...)
+}
+
+// 映射 Claude 模型到内部模型，注册表中的模型名和别名（如 GLM-4.7-thinking）直接使用
 func mapClaudeModel(claudeModel string) string {
-	// Claude 模型映射到 GLM 模型
-	if strings.Contains(claudeModel, "opus") || strings.Contains(claudeModel, "sonnet") {
-		return "GLM-4.6"
+	if GetModelRegistry().Resolve(claudeModel).Definition != nil {
+		return claudeModel
 	}
-	return "GLM-4.5"
+	name := strings.ToLower(claudeModel)
+	for _, rule := range Cfg.ClaudeModelMap {
+		if ok, _ := path.Match(strings.ToLower(rule.Pattern), name); ok {
+			return rule.Model
+		}
+	}
+	return claudeModel
+}
+
+// 根据请求的 thinking 字段开关上游思考模式
+func applyClaudeThinking(model string, thinking *ClaudeThinkingConfig) string {
+	if thinking == nil {
+		return model
+	}
+	baseModel, enableThinking, enableSearch := ParseModelName(model)
+	switch thinking.Type {
+	case "enabled":
+		enableThinking = true
+	case "disabled":
+		enableThinking = false
+	}
+	if enableThinking {
+		baseModel += "-thinking"
+	}
+	if enableSearch {
+		baseModel += "-search"
+	}
+	return baseModel
 }
 
 // 解析 system 字段，支持字符串或数组格式
@@ -142,6 +316,19 @@ func parseSystemMessage(systemRaw json.RawMessage) string {
 	return ""
 }
 
+// writeClaudeError 返回 Anthropic 格式的错误响应
+func writeClaudeError(w http.ResponseWriter, status int, errType, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type": "error",
+		"error": map[string]string{
+			"type":    errType,
+			"message": message,
+		},
+	})
+}
+
 func HandleClaudeChatCompletions(w http.ResponseWriter, r *http.Request) {
 	// 处理 CORS 预检请求
 	if r.Method == "OPTIONS" {
@@ -154,37 +341,36 @@ func HandleClaudeChatCompletions(w http.ResponseWriter, r *http.Request) {
 
 	// 设置 CORS 头
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	
-	LogDebug("[Claude] Method: %s, Headers: x-api-key=%s, Authorization=%s", r.Method, r.Header.Get("x-api-key"), r.Header.Get("Authorization"))
-	
+
 	apiKey := r.Header.Get("x-api-key")
 	if apiKey == "" {
 		apiKey = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
 	}
 	if apiKey == "" {
 		LogError("[Claude] Missing API key")
-		w.Header().Set("Content-Type", "application/json")
-		http.Error(w, `{"error":{"type":"authentication_error","message":"Missing API key"}}`, http.StatusUnauthorized)
+		writeClaudeError(w, http.StatusUnauthorized, "authentication_error", "Missing API key")
 		return
 	}
-	
-	LogDebug("[Claude] Using API key: %s...", apiKey[:min(10, len(apiKey))])
-
-	// 如果是 Anthropic 的 API key 或 "free"，使用匿名 token
-	if apiKey == "free" || strings.HasPrefix(apiKey, "sk-ant-") {
-		LogInfo("[Claude] Detected Anthropic API key or 'free', using anonymous token")
-		anonymousToken, err := GetAnonymousToken()
-		if err != nil {
-			LogError("Failed to get anonymous token: %v", err)
-			w.Header().Set("Content-Type", "application/json")
-			http.Error(w, `{"error":{"type":"api_error","message":"Failed to get token"}}`, http.StatusInternalServerError)
-			return
-		}
-		apiKey = anonymousToken
-		LogInfo("[Claude] Got anonymous token: %s...", apiKey[:min(20, len(apiKey))])
-	} else {
-		LogInfo("[Claude] Using provided z.ai token: %s...", apiKey[:min(20, len(apiKey))])
+
+	LogDebug("[Claude] Using API key: %s", maskToken(apiKey))
+
+	lease, err := resolveToken(r.Context(), apiKey)
+	if authErr, ok := err.(authError); ok {
+		LogWarn("[Claude] Rejected API key %s: %v", maskToken(apiKey), authErr)
+		writeClaudeError(w, http.StatusUnauthorized, "authentication_error", authErr.Error())
+		return
 	}
+	if err == errPoolExhausted {
+		LogError("[Claude] Token pool exhausted")
+		writeClaudeError(w, http.StatusServiceUnavailable, "overloaded_error", "No available upstream token")
+		return
+	}
+	if err != nil {
+		LogError("[Claude] Failed to get upstream token: %v", err)
+		writeClaudeError(w, http.StatusInternalServerError, "api_error", "Failed to get token")
+		return
+	}
+	defer lease.Release()
 
 	var req ClaudeRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -194,9 +380,16 @@ func HandleClaudeChatCompletions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := lease.CheckLimits(w, req.Stream); err != nil {
+		LogWarn("[Claude] Rate limited API key %s: %v", maskToken(apiKey), err)
+		writeClaudeError(w, http.StatusTooManyRequests, "rate_limit_error", err.Error())
+		return
+	}
+
 	LogDebug("[Claude] Request: model=%s, messages=%d, stream=%v", req.Model, len(req.Messages), req.Stream)
 
-	internalModel := mapClaudeModel(req.Model)
+	internalModel := applyClaudeThinking(mapClaudeModel(req.Model), req.Thinking)
+	LogDebug("[Claude] Mapped model %s to %s", req.Model, internalModel)
 	messages := convertClaudeMessages(req.Messages)
 
 	// 处理 system 消息
@@ -205,11 +398,38 @@ func HandleClaudeChatCompletions(w http.ResponseWriter, r *http.Request) {
 		messages = append([]Message{{Role: "system", Content: systemMsg}}, messages...)
 	}
 
-	resp, _, err := makeUpstreamRequest(apiKey, messages, internalModel)
+	tools := convertClaudeTools(req.Tools)
+	if err := validateToolChoice(tools, req.ToolChoice); err != nil {
+		writeClaudeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	opts := &responseOptions{thinkingEnabled: IsThinkingModel(internalModel)}
+	if len(req.Tools) > 0 || hasToolMessages(messages) {
+		messages = applyToolEmulation(messages, tools, req.ToolChoice)
+		enabled, _, _ := parseToolChoice(req.ToolChoice)
+		opts.toolsEnabled = enabled && len(req.Tools) > 0
+	}
+	opts.promptTokens = EstimateMessagesTokens(messages)
+	opts.maxTokens = req.MaxTokens
+	opts.stopSequences = req.StopSequences
+	if req.Thinking != nil && req.Thinking.Type == "enabled" {
+		opts.reasoningBudget = req.Thinking.BudgetTokens
+	}
+
+	resp, targetModel, usedModel, err := sendWithFallback(r.Context(), lease, messages, internalModel, newImageUploads())
 	if err != nil {
+		if isClientGone(r.Context(), err) {
+			LogDebug("[Claude] Client disconnected before upstream responded")
+			return
+		}
 		LogError("[Claude] Upstream request failed: %v", err)
+		if err == errUpstreamTimeout {
+			writeClaudeError(w, http.StatusGatewayTimeout, "api_error", "Upstream timed out")
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		if strings.Contains(err.Error(), "invalid token") {
+		if err == errInvalidToken {
 			http.Error(w, `{"error":{"type":"authentication_error","message":"Invalid API key"}}`, http.StatusUnauthorized)
 		} else {
 			http.Error(w, `{"error":{"type":"api_error","message":"Upstream error"}}`, http.StatusBadGateway)
@@ -224,270 +444,276 @@ func HandleClaudeChatCompletions(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error":{"type":"api_error","message":"Upstream error"}}`, resp.StatusCode)
 		return
 	}
+	// 上游请求失败时不计入 key 的用量
+	defer func() { lease.RecordUsage(opts.promptTokens + opts.completionTokens) }()
+
+	// 使用了后备模型时在 model 字段中返回实际模型
+	responseModel := req.Model
+	if usedModel != internalModel {
+		responseModel = usedModel
+		opts.thinkingEnabled = IsThinkingModel(usedModel)
+	}
+	w.Header().Set("X-Model-Used", usedModel)
 
 	completionID := fmt.Sprintf("msg_%s", uuid.New().String()[:24])
+	body := recordUpstream(resp.Body, completionID, RecordingMeta{
+		Model:       responseModel,
+		TargetModel: targetModel,
+		Thinking:    opts.thinkingEnabled,
+		Tools:       opts.toolsEnabled,
+	})
+	defer body.Close()
 
 	if req.Stream {
-		handleClaudeStreamResponse(w, resp.Body, completionID, req.Model)
+		handleClaudeStreamResponse(w, body, completionID, responseModel, opts)
 	} else {
-		handleClaudeNonStreamResponse(w, resp.Body, completionID, req.Model)
+		handleClaudeNonStreamResponse(w, body, completionID, responseModel, opts)
 	}
 }
 
-func handleClaudeStreamResponse(w http.ResponseWriter, body io.ReadCloser, completionID, model string) {
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+// claudeStreamRenderer 将输出写成 Claude 的流式事件，负责内容块编号与开闭
+type claudeStreamRenderer struct {
+	w         http.ResponseWriter
+	flusher   http.Flusher
+	opts      *responseOptions
+	index     int
+	openType  string
+	hasOpened bool
+	// 已输出内容的估算 token 数，用于 message_delta 的 usage
+	outputTokens TokenCounter
+}
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
-		return
-	}
+func (b *claudeStreamRenderer) writeEvent(eventType string, event map[string]interface{}) {
+	data, _ := json.Marshal(event)
+	fmt.Fprintf(b.w, "event: %s\ndata: %s\n\n", eventType, data)
+	b.flusher.Flush()
+}
 
-	// 发送 message_start
-	startEvent := map[string]interface{}{
-		"type": "message_start",
-		"message": map[string]interface{}{
-			"id":    completionID,
-			"type":  "message",
-			"role":  "assistant",
-			"model": model,
-			"usage": map[string]interface{}{
-				"input_tokens":  0,
-				"output_tokens": 0,
-			},
-		},
+func (b *claudeStreamRenderer) startBlock(block map[string]interface{}) {
+	b.stopBlock()
+	if b.hasOpened {
+		b.index++
 	}
-	data, _ := json.Marshal(startEvent)
-	fmt.Fprintf(w, "event: message_start\ndata: %s\n\n", data)
-	flusher.Flush()
-
-	// 发送 content_block_start
-	blockStart := map[string]interface{}{
-		"type":         "content_block_start",
-		"index":        0,
-		"content_block": map[string]interface{}{"type": "text", "text": ""},
-	}
-	data, _ = json.Marshal(blockStart)
-	fmt.Fprintf(w, "event: content_block_start\ndata: %s\n\n", data)
-	flusher.Flush()
-
-	scanner := bufio.NewScanner(body)
-	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
-	searchRefFilter := NewSearchRefFilter()
-	thinkingFilter := &ThinkingFilter{}
-	pendingSourcesMarkdown := ""
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-
-		payload := strings.TrimPrefix(line, "data: ")
-		if payload == "[DONE]" {
-			break
-		}
-
-		var upstream UpstreamData
-		if err := json.Unmarshal([]byte(payload), &upstream); err != nil {
-			continue
-		}
-
-		if upstream.Data.Phase == "done" {
-			break
-		}
-
-		if upstream.Data.Phase == "thinking" && upstream.Data.DeltaContent != "" {
-			if pendingSourcesMarkdown != "" {
-				pendingSourcesMarkdown = ""
-			}
-			thinkingFilter.ProcessThinking(upstream.Data.DeltaContent)
-			continue
-		}
-
-		if upstream.Data.EditContent != "" && IsSearchResultContent(upstream.Data.EditContent) {
-			if results := ParseSearchResults(upstream.Data.EditContent); len(results) > 0 {
-				searchRefFilter.AddSearchResults(results)
-				pendingSourcesMarkdown = searchRefFilter.GetSearchResultsMarkdown()
-			}
-			continue
-		}
+	b.hasOpened = true
+	b.openType, _ = block["type"].(string)
+	b.writeEvent("content_block_start", map[string]interface{}{
+		"type":          "content_block_start",
+		"index":         b.index,
+		"content_block": block,
+	})
+}
 
-		if upstream.Data.EditContent != "" && IsSearchToolCall(upstream.Data.EditContent, upstream.Data.Phase) {
-			continue
-		}
+func (b *claudeStreamRenderer) stopBlock() {
+	if b.openType == "" {
+		return
+	}
+	if b.openType == "thinking" {
+		b.delta(map[string]interface{}{"type": "signature_delta", "signature": claudeThinkingSignature})
+	}
+	b.writeEvent("content_block_stop", map[string]interface{}{"type": "content_block_stop", "index": b.index})
+	b.openType = ""
+}
 
-		if pendingSourcesMarkdown != "" {
-			delta := map[string]interface{}{
-				"type":  "content_block_delta",
-				"index": 0,
-				"delta": map[string]interface{}{"type": "text_delta", "text": pendingSourcesMarkdown},
-			}
-			data, _ := json.Marshal(delta)
-			fmt.Fprintf(w, "event: content_block_delta\ndata: %s\n\n", data)
-			flusher.Flush()
-			pendingSourcesMarkdown = ""
-		}
+func (b *claudeStreamRenderer) delta(delta map[string]interface{}) {
+	b.writeEvent("content_block_delta", map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": b.index,
+		"delta": delta,
+	})
+}
 
-		content := ""
-		if upstream.Data.Phase == "answer" && upstream.Data.DeltaContent != "" {
-			content = upstream.Data.DeltaContent
-		} else if upstream.Data.Phase == "answer" && upstream.Data.EditContent != "" {
-			if strings.Contains(upstream.Data.EditContent, "</details>") {
-				thinkingFilter.ExtractCompleteThinking(upstream.Data.EditContent)
-				if idx := strings.Index(upstream.Data.EditContent, "</details>\n"); idx != -1 {
-					content = upstream.Data.EditContent[idx+len("</details>\n"):]
-				}
-			}
-		} else if (upstream.Data.Phase == "other" || upstream.Data.Phase == "tool_call") && upstream.Data.EditContent != "" {
-			content = upstream.Data.EditContent
-		}
+func (b *claudeStreamRenderer) Text(text string) {
+	if b.openType != "text" {
+		b.startBlock(map[string]interface{}{"type": "text", "text": ""})
+	}
+	b.outputTokens.Add(text)
+	b.delta(map[string]interface{}{"type": "text_delta", "text": text})
+}
 
-		if content == "" {
-			continue
-		}
+func (b *claudeStreamRenderer) Reasoning(thinking string) {
+	if b.openType != "thinking" {
+		b.startBlock(map[string]interface{}{"type": "thinking", "thinking": ""})
+	}
+	b.outputTokens.Add(thinking)
+	b.delta(map[string]interface{}{"type": "thinking_delta", "thinking": thinking})
+}
 
-		content = searchRefFilter.Process(content)
-		if content == "" {
-			continue
-		}
+func (b *claudeStreamRenderer) ToolCall(call ToolCall) {
+	b.outputTokens.Add(call.Function.Name + call.Function.Arguments)
+	b.startBlock(map[string]interface{}{
+		"type":  "tool_use",
+		"id":    claudeToolUseID(call),
+		"name":  call.Function.Name,
+		"input": map[string]interface{}{},
+	})
+	b.delta(map[string]interface{}{"type": "input_json_delta", "partial_json": string(claudeToolInput(call))})
+	b.stopBlock()
+}
 
-		delta := map[string]interface{}{
-			"type":  "content_block_delta",
-			"index": 0,
-			"delta": map[string]interface{}{"type": "text_delta", "text": content},
-		}
-		data, _ = json.Marshal(delta)
-		fmt.Fprintf(w, "event: content_block_delta\ndata: %s\n\n", data)
-		flusher.Flush()
+func (b *claudeStreamRenderer) Error(err error) {
+	failure := classifyReadError(err)
+	if failure == nil {
+		LogDebug("[Claude] Stream ended: %v", err)
+		return
 	}
+	LogWarn("[Claude] Upstream stream failed: %v", err)
+	b.opts.completionTokens = b.outputTokens.Count()
+	// 与正常结束一样先关闭未结束的内容块
+	b.stopBlock()
+	// error 事件之后不再发送 message_stop，客户端应视为请求失败
+	b.writeEvent("error", map[string]interface{}{
+		"type": "error",
+		"error": map[string]interface{}{
+			"type":    "api_error",
+			"message": failure.message,
+		},
+	})
+}
 
-	if remaining := searchRefFilter.Flush(); remaining != "" {
-		delta := map[string]interface{}{
-			"type":  "content_block_delta",
-			"index": 0,
-			"delta": map[string]interface{}{"type": "text_delta", "text": remaining},
-		}
-		data, _ := json.Marshal(delta)
-		fmt.Fprintf(w, "event: content_block_delta\ndata: %s\n\n", data)
-		flusher.Flush()
+func (b *claudeStreamRenderer) Finish(reason, stopSequence string) {
+	if !b.hasOpened {
+		b.startBlock(map[string]interface{}{"type": "text", "text": ""})
 	}
 
 	// 发送 content_block_stop
-	blockStop := map[string]interface{}{"type": "content_block_stop", "index": 0}
-	data, _ = json.Marshal(blockStop)
-	fmt.Fprintf(w, "event: content_block_stop\ndata: %s\n\n", data)
-	flusher.Flush()
+	b.stopBlock()
+
+	stopReason, sequence := claudeStopReason(reason, stopSequence)
+	var sequenceValue interface{}
+	if sequence != nil {
+		sequenceValue = *sequence
+	}
 
 	// 发送 message_delta
-	messageDelta := map[string]interface{}{
+	b.writeEvent("message_delta", map[string]interface{}{
 		"type": "message_delta",
 		"delta": map[string]interface{}{
-			"stop_reason": "end_turn",
+			"stop_reason":   stopReason,
+			"stop_sequence": sequenceValue,
 		},
 		"usage": map[string]interface{}{
-			"output_tokens": 0,
+			"output_tokens": b.outputTokens.Count(),
 		},
-	}
-	data, _ = json.Marshal(messageDelta)
-	fmt.Fprintf(w, "event: message_delta\ndata: %s\n\n", data)
-	flusher.Flush()
+	})
+	b.opts.completionTokens = b.outputTokens.Count()
 
 	// 发送 message_stop
-	messageStop := map[string]interface{}{"type": "message_stop"}
-	data, _ = json.Marshal(messageStop)
-	fmt.Fprintf(w, "event: message_stop\ndata: %s\n\n", data)
-	flusher.Flush()
-}
-
-func handleClaudeNonStreamResponse(w http.ResponseWriter, body io.ReadCloser, completionID, model string) {
-	scanner := bufio.NewScanner(body)
-	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
-	var chunks []string
-	thinkingFilter := &ThinkingFilter{}
-	searchRefFilter := NewSearchRefFilter()
-	pendingSourcesMarkdown := ""
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
+	b.writeEvent("message_stop", map[string]interface{}{"type": "message_stop"})
+}
 
-		payload := strings.TrimPrefix(line, "data: ")
-		if payload == "[DONE]" {
-			break
-		}
+// claudeStopReason 将结束原因转换为 Claude 的 stop_reason，命中停止序列时同时返回该序列
+func claudeStopReason(reason, stopSequence string) (string, *string) {
+	switch reason {
+	case finishToolCalls:
+		return "tool_use", nil
+	case limitReasonLength:
+		return "max_tokens", nil
+	case limitReasonStopSequence:
+		return "stop_sequence", &stopSequence
+	}
+	return "end_turn", nil
+}
 
-		var upstream UpstreamData
-		if err := json.Unmarshal([]byte(payload), &upstream); err != nil {
-			continue
-		}
+func handleClaudeStreamResponse(w http.ResponseWriter, body io.ReadCloser, completionID, model string, opts *responseOptions) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
 
-		if upstream.Data.Phase == "done" {
-			break
-		}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	blocks := &claudeStreamRenderer{w: w, flusher: flusher, opts: opts}
 
-		if upstream.Data.Phase == "thinking" && upstream.Data.DeltaContent != "" {
-			thinkingFilter.ProcessThinking(upstream.Data.DeltaContent)
-			continue
-		}
+	// 发送 message_start
+	blocks.writeEvent("message_start", map[string]interface{}{
+		"type": "message_start",
+		"message": map[string]interface{}{
+			"id":    completionID,
+			"type":  "message",
+			"role":  "assistant",
+			"model": model,
+			"usage": map[string]interface{}{
+				"input_tokens":  opts.promptTokens,
+				"output_tokens": 0,
+			},
+		},
+	})
 
-		if upstream.Data.EditContent != "" && IsSearchResultContent(upstream.Data.EditContent) {
-			if results := ParseSearchResults(upstream.Data.EditContent); len(results) > 0 {
-				searchRefFilter.AddSearchResults(results)
-				pendingSourcesMarkdown = searchRefFilter.GetSearchResultsMarkdown()
-			}
-			continue
-		}
+	// 思考模式下 thinking 块位于 index 0，text 块延迟到有正文时再开启
+	if !opts.thinkingEnabled {
+		blocks.startBlock(map[string]interface{}{"type": "text", "text": ""})
+	}
 
-		if upstream.Data.EditContent != "" && IsSearchToolCall(upstream.Data.EditContent, upstream.Data.Phase) {
-			continue
-		}
+	pipeline := newEventPipeline(blocks, opts)
+	pipeline.dropReasoning = !opts.thinkingEnabled
+	pipeline.Run(body)
+}
 
-		if pendingSourcesMarkdown != "" {
-			chunks = append(chunks, pendingSourcesMarkdown)
-			pendingSourcesMarkdown = ""
+func handleClaudeNonStreamResponse(w http.ResponseWriter, body io.ReadCloser, completionID, model string, opts *responseOptions) {
+	result := collectResponse(body, opts, !opts.thinkingEnabled)
+	if result.err != nil {
+		if failure := classifyReadError(result.err); failure != nil {
+			LogWarn("[Claude] Upstream response failed: %v", result.err)
+			writeClaudeError(w, failure.status, "api_error", failure.message)
+		} else {
+			LogDebug("[Claude] Non-stream response aborted: %v", result.err)
 		}
+		return
+	}
 
-		content := ""
-		if upstream.Data.Phase == "answer" && upstream.Data.DeltaContent != "" {
-			content = upstream.Data.DeltaContent
-		} else if upstream.Data.Phase == "answer" && upstream.Data.EditContent != "" {
-			if strings.Contains(upstream.Data.EditContent, "</details>") {
-				thinkingFilter.ExtractCompleteThinking(upstream.Data.EditContent)
-				if idx := strings.Index(upstream.Data.EditContent, "</details>\n"); idx != -1 {
-					content = upstream.Data.EditContent[idx+len("</details>\n"):]
-				}
-			}
-		} else if (upstream.Data.Phase == "other" || upstream.Data.Phase == "tool_call") && upstream.Data.EditContent != "" {
-			content = upstream.Data.EditContent
-		}
+	var contentBlocks []ClaudeContent
+	if result.reasoning != "" {
+		contentBlocks = append(contentBlocks, ClaudeContent{
+			Type:      "thinking",
+			Thinking:  result.reasoning,
+			Signature: claudeThinkingSignature,
+		})
+	}
+	if result.content != "" || len(result.toolCalls) == 0 {
+		contentBlocks = append(contentBlocks, ClaudeContent{
+			Type: "text",
+			Text: result.content,
+		})
+	}
+	for _, call := range result.toolCalls {
+		contentBlocks = append(contentBlocks, ClaudeContent{
+			Type:  "tool_use",
+			ID:    claudeToolUseID(call),
+			Name:  call.Function.Name,
+			Input: claudeToolInput(call),
+		})
+	}
 
-		if content != "" {
-			chunks = append(chunks, content)
+	var outputTokens TokenCounter
+	for _, block := range contentBlocks {
+		outputTokens.Add(block.Text + block.Thinking + block.Name)
+		if block.Type == "tool_use" {
+			outputTokens.Add(string(block.Input))
 		}
 	}
 
-	fullContent := strings.Join(chunks, "")
-	fullContent = searchRefFilter.Process(fullContent) + searchRefFilter.Flush()
+	reason := result.limitReason
+	if len(result.toolCalls) > 0 {
+		reason = finishToolCalls
+	}
+	stopReason, stopSequence := claudeStopReason(reason, result.stopSequence)
 
 	response := ClaudeResponse{
-		ID:    completionID,
-		Type:  "message",
-		Role:  "assistant",
-		Model: model,
-		Content: []ClaudeContent{{
-			Type: "text",
-			Text: fullContent,
-		}},
+		ID:           completionID,
+		Type:         "message",
+		Role:         "assistant",
+		Model:        model,
+		Content:      contentBlocks,
+		StopReason:   stopReason,
+		StopSequence: stopSequence,
 		Usage: map[string]int{
-			"input_tokens":  0,
-			"output_tokens": 0,
+			"input_tokens":  opts.promptTokens,
+			"output_tokens": outputTokens.Count(),
 		},
 	}
+	opts.completionTokens = outputTokens.Count()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
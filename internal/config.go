@@ -2,12 +2,83 @@ package internal
 
 import (
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	Port string
+	Port           string
+	JSONMaxRetries int
+
+	// z.ai 上游地址，可指向 zai-stub 离线测试
+	UpstreamBaseURL string
+	// 录制上游 SSE 的目录，为空时不录制
+	RecordDir string
+
+	// 上游超时：建立连接、等待首字节、两次读取之间
+	UpstreamConnectTimeout   time.Duration
+	UpstreamFirstByteTimeout time.Duration
+	UpstreamIdleTimeout      time.Duration
+	// 单个上游 SSE 事件的最大字节数，超过时向客户端返回错误
+	UpstreamMaxEventSize int
+
+	// 上游连接池、出口代理和 CA 证书
+	UpstreamProxy               string
+	UpstreamCAFile              string
+	UpstreamMaxIdleConns        int
+	UpstreamMaxIdleConnsPerHost int
+	UpstreamMaxConnsPerHost     int
+	UpstreamIdleConnTimeout     time.Duration
+
+	// 上游重试：首字节之前的网络错误、429 和 5xx
+	UpstreamMaxRetries      int
+	UpstreamRetryBackoff    time.Duration
+	UpstreamRetryMaxBackoff time.Duration
+
+	// 前端版本号：固定值、持久化文件和抓取间隔
+	FeVersion                string
+	FeVersionFile            string
+	FeVersionRefreshInterval time.Duration
+
+	// 签名方案配置文件及检查修改的间隔
+	SignerFile           string
+	SignerReloadInterval time.Duration
+
+	// 模型注册表文件及检查修改的间隔
+	ModelsFile           string
+	ModelsReloadInterval time.Duration
+	// 从 z.ai 拉取模型列表的间隔，0 表示不拉取
+	ModelDiscoveryInterval time.Duration
+
+	// 模型后备链：模型名 -> 依次尝试的后备模型
+	ModelFallbacks map[string][]string
+
+	// Claude 模型名到内部模型的映射，按顺序匹配
+	ClaudeModelMap []ClaudeModelRule
+
+	// 账号池
+	ProxyAPIKey     string
+	AdminKey        string
+	PoolTokens      []string
+	PoolFile        string
+	PoolStrategy    string
+	PoolCooldown    time.Duration
+	PoolMaxFailures int
+
+	// 客户端认证
+	APIKeysFile      string
+	AllowAnonymous   bool
+	AnthropicKeyFree bool
+	AllowRawTokens   bool
+	AllowProxyAPIKey bool
+
+	// 匿名 token 缓存
+	AnonPoolSize      int
+	AnonTokenTTL      time.Duration
+	AnonRefreshBefore time.Duration
 }
 
 var Cfg *Config
@@ -21,6 +92,133 @@ func LoadConfig() {
 	}
 
 	Cfg = &Config{
-		Port: port,
+		Port:           port,
+		JSONMaxRetries: getEnvInt("JSON_MAX_RETRIES", 1),
+
+		UpstreamBaseURL: strings.TrimRight(getEnv("UPSTREAM_BASE_URL", "https://chat.z.ai"), "/"),
+		RecordDir:       os.Getenv("RECORD_DIR"),
+
+		UpstreamConnectTimeout:   getEnvDuration("UPSTREAM_CONNECT_TIMEOUT", 10*time.Second),
+		UpstreamFirstByteTimeout: getEnvDuration("UPSTREAM_FIRST_BYTE_TIMEOUT", 60*time.Second),
+		UpstreamIdleTimeout:      getEnvDuration("UPSTREAM_IDLE_TIMEOUT", 60*time.Second),
+		UpstreamMaxEventSize:     getEnvSize("UPSTREAM_MAX_EVENT_SIZE", 16<<20),
+
+		UpstreamProxy:               os.Getenv("UPSTREAM_PROXY"),
+		UpstreamCAFile:              os.Getenv("UPSTREAM_CA_FILE"),
+		UpstreamMaxIdleConns:        getEnvInt("UPSTREAM_MAX_IDLE_CONNS", 100),
+		UpstreamMaxIdleConnsPerHost: getEnvInt("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", 32),
+		UpstreamMaxConnsPerHost:     getEnvInt("UPSTREAM_MAX_CONNS_PER_HOST", 0),
+		UpstreamIdleConnTimeout:     getEnvDuration("UPSTREAM_IDLE_CONN_TIMEOUT", 90*time.Second),
+
+		UpstreamMaxRetries:      getEnvInt("UPSTREAM_MAX_RETRIES", 2),
+		UpstreamRetryBackoff:    getEnvDuration("UPSTREAM_RETRY_BACKOFF", 500*time.Millisecond),
+		UpstreamRetryMaxBackoff: getEnvDuration("UPSTREAM_RETRY_MAX_BACKOFF", 5*time.Second),
+
+		FeVersion:                os.Getenv("FE_VERSION"),
+		FeVersionFile:            os.Getenv("FE_VERSION_FILE"),
+		FeVersionRefreshInterval: getEnvDuration("FE_VERSION_REFRESH_INTERVAL", time.Hour),
+
+		SignerFile:           os.Getenv("SIGNER_FILE"),
+		SignerReloadInterval: getEnvDuration("SIGNER_RELOAD_INTERVAL", 30*time.Second),
+
+		ModelsFile:             os.Getenv("MODELS_FILE"),
+		ModelsReloadInterval:   getEnvDuration("MODELS_RELOAD_INTERVAL", 30*time.Second),
+		ModelDiscoveryInterval: getEnvDuration("MODEL_DISCOVERY_INTERVAL", time.Hour),
+
+		ModelFallbacks: parseModelFallbacks(getEnvList("MODEL_FALLBACKS")),
+		ClaudeModelMap: parseClaudeModelMap(getEnvList("CLAUDE_MODEL_MAP")),
+
+		ProxyAPIKey:     os.Getenv("PROXY_API_KEY"),
+		AdminKey:        os.Getenv("ADMIN_KEY"),
+		PoolTokens:      getEnvList("ZAI_TOKENS"),
+		PoolFile:        os.Getenv("TOKEN_POOL_FILE"),
+		PoolStrategy:    getEnv("POOL_STRATEGY", "round_robin"),
+		PoolCooldown:    getEnvDuration("POOL_COOLDOWN", 30*time.Second),
+		PoolMaxFailures: getEnvInt("POOL_MAX_FAILURES", 3),
+
+		APIKeysFile: os.Getenv("API_KEYS_FILE"),
+		// 启用代理签发的 key 后默认不再允许 free、sk-ant- key、透传 z.ai token 和 PROXY_API_KEY 绕过 key 的限额与吊销
+		AllowAnonymous:   getEnvBool("ALLOW_ANONYMOUS", os.Getenv("API_KEYS_FILE") == ""),
+		AnthropicKeyFree: getEnvBool("ANTHROPIC_KEY_AS_FREE", os.Getenv("API_KEYS_FILE") == ""),
+		AllowRawTokens:   getEnvBool("ALLOW_RAW_TOKENS", os.Getenv("API_KEYS_FILE") == ""),
+		AllowProxyAPIKey: getEnvBool("ALLOW_PROXY_API_KEY", os.Getenv("API_KEYS_FILE") == ""),
+
+		AnonPoolSize:      getEnvInt("ANON_POOL_SIZE", 3),
+		AnonTokenTTL:      getEnvDuration("ANON_TOKEN_TTL", 30*time.Minute),
+		AnonRefreshBefore: getEnvDuration("ANON_REFRESH_BEFORE", 5*time.Minute),
+	}
+}
+
+// upstreamURL 拼接上游地址，path 以 / 开头
+func upstreamURL(path string) string {
+	return Cfg.UpstreamBaseURL + path
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil && v >= 0 {
+		return v
+	}
+	return fallback
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	if v, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+// 支持 "30s" / "5m" 格式，纯数字按秒处理
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return d
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	return fallback
+}
+
+// 支持 "16MB" / "512KB" 格式（按 1024 换算），纯数字按字节处理
+func getEnvSize(key string, fallback int) int {
+	v := strings.ToUpper(strings.TrimSpace(os.Getenv(key)))
+	if v == "" {
+		return fallback
+	}
+	unit := 1
+	for _, u := range []struct {
+		suffix string
+		size   int
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(v, u.suffix) {
+			v, unit = strings.TrimSpace(strings.TrimSuffix(v, u.suffix)), u.size
+			break
+		}
+	}
+	if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+		return n * unit
+	}
+	return fallback
+}
+
+// 逗号分隔的列表，忽略空项
+func getEnvList(key string) []string {
+	var result []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
 	}
+	return result
 }
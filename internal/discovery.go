@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/corpix/uarand"
+)
+
+// upstreamModel 是 z.ai /api/models 返回的模型
+type upstreamModel struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Info struct {
+		IsActive *bool `json:"is_active"`
+		Meta     struct {
+			Capabilities map[string]interface{} `json:"capabilities"`
+		} `json:"meta"`
+	} `json:"info"`
+}
+
+func (m upstreamModel) active() bool {
+	return m.Info.IsActive == nil || *m.Info.IsActive
+}
+
+// capability 读取上游标注的能力，未标注时使用 fallback
+func (m upstreamModel) capability(name string, fallback bool) bool {
+	if v, ok := m.Info.Meta.Capabilities[name].(bool); ok {
+		return v
+	}
+	return fallback
+}
+
+var (
+	// 上一次拉取到的上游模型 ID
+	lastUpstreamModels map[string]bool
+	// 已提示过下线的上游模型 ID，重新出现时清除
+	missingUpstreamModels = make(map[string]bool)
+)
+
+// StartModelDiscovery 定期从 z.ai 拉取模型列表，将未注册的模型加入 /v1/models，并提示已映射模型的下线
+func StartModelDiscovery() {
+	if Cfg.ModelDiscoveryInterval <= 0 {
+		return
+	}
+
+	go func() {
+		discoverModels()
+		ticker := time.NewTicker(Cfg.ModelDiscoveryInterval)
+		for range ticker.C {
+			discoverModels()
+		}
+	}()
+}
+
+func discoverModels() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	models, err := fetchUpstreamModels(ctx)
+	if err != nil {
+		LogError("Failed to fetch upstream models: %v", err)
+		return
+	}
+
+	available := make(map[string]bool)
+	for _, m := range models {
+		if m.ID != "" && m.active() {
+			available[m.ID] = true
+		}
+	}
+	if len(available) == 0 {
+		LogWarn("[Models] Upstream model list is empty, ignoring")
+		return
+	}
+
+	base := getBaseModelRegistry()
+	mapped := base.upstreamIDs()
+
+	// 注册表中映射的和上次拉取到的模型不再出现时提示下线
+	watched := base.upstreamIDs()
+	for id := range lastUpstreamModels {
+		watched[id] = true
+	}
+	for id := range watched {
+		switch {
+		case !available[id] && !missingUpstreamModels[id]:
+			missingUpstreamModels[id] = true
+			LogWarn("[Models] Upstream model %s is no longer listed by z.ai%s", id, describeMappedModels(base, id))
+		case available[id] && missingUpstreamModels[id]:
+			delete(missingUpstreamModels, id)
+			LogInfo("[Models] Upstream model %s is listed again", id)
+		}
+	}
+
+	var discovered []ModelDefinition
+	for _, m := range models {
+		if !available[m.ID] || mapped[m.ID] {
+			continue
+		}
+		def := guessModelDefinition(m)
+		if !lastUpstreamModels[m.ID] {
+			LogInfo("[Models] Discovered upstream model %s (%s), vision=%v thinking=%v search=%v",
+				m.ID, m.Name, def.Capabilities.Vision, def.Capabilities.Thinking, def.Capabilities.Search)
+		}
+		discovered = append(discovered, def)
+	}
+	setDiscoveredModels(discovered)
+	lastUpstreamModels = available
+	LogDebug("[Models] Fetched %d upstream models, %d not in registry", len(available), len(discovered))
+}
+
+// describeMappedModels 列出映射到该上游 ID 的模型名
+func describeMappedModels(registry *ModelRegistry, upstream string) string {
+	var names []string
+	for _, m := range registry.Models {
+		if m.Upstream == upstream {
+			names = append(names, m.ID)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (used by %s), requests to it may start failing", strings.Join(names, ", "))
+}
+
+// guessModelDefinition 根据上游标注推断能力，未标注时名称以 v 结尾的视为视觉模型，视觉模型不启用搜索
+func guessModelDefinition(m upstreamModel) ModelDefinition {
+	vision := m.capability("vision", strings.HasSuffix(strings.ToLower(m.ID), "v"))
+	return ModelDefinition{
+		ID:       m.ID,
+		Upstream: m.ID,
+		Capabilities: ModelCapabilities{
+			Vision:   vision,
+			Thinking: m.capability("think", true),
+			Search:   m.capability("web_search", !vision),
+			Tools:    true,
+		},
+		Discovered: true,
+	}
+}
+
+// fetchUpstreamModels 使用匿名 token 请求 z.ai 的模型列表
+func fetchUpstreamModels(ctx context.Context) ([]upstreamModel, error) {
+	token, err := AnonTokens.Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get anonymous token: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", upstreamURL("/api/models"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-FE-Version", GetFeVersion())
+	req.Header.Set("Origin", Cfg.UpstreamBaseURL)
+	req.Header.Set("User-Agent", uarand.GetRandom())
+
+	resp, err := doUpstream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var result struct {
+		Data []upstreamModel `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Data, nil
+}
@@ -0,0 +1,411 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// errUpstreamTruncated 表示上游在发送结束标记之前断开
+var errUpstreamTruncated = errors.New("upstream stream ended before completion")
+
+// UpstreamError 是上游在 SSE 中返回的错误
+type UpstreamError struct {
+	Code    string
+	Message string
+}
+
+func (e *UpstreamError) Error() string {
+	if e.Code == "" {
+		return "upstream error: " + e.Message
+	}
+	return fmt.Sprintf("upstream error %s: %s", e.Code, e.Message)
+}
+
+type UpstreamData struct {
+	Type string `json:"type"`
+	Data struct {
+		DeltaContent string          `json:"delta_content"`
+		EditContent  string          `json:"edit_content"`
+		Phase        string          `json:"phase"`
+		Done         bool            `json:"done"`
+		Error        json.RawMessage `json:"error"`
+	} `json:"data"`
+	// 错误可能位于顶层或 data 中，也可能是不带 type 的 {"detail": "..."}
+	Error  json.RawMessage `json:"error"`
+	Detail string          `json:"detail"`
+}
+
+// GetError 返回事件中携带的上游错误，没有错误时返回 nil
+func (u *UpstreamData) GetError() *UpstreamError {
+	raw := u.Error
+	if isJSONEmpty(raw) {
+		raw = u.Data.Error
+	}
+	if isJSONEmpty(raw) {
+		switch {
+		case u.Type == "error":
+			return &UpstreamError{Message: "unknown error"}
+		case u.Type == "" && u.Detail != "":
+			return &UpstreamError{Message: u.Detail}
+		}
+		return nil
+	}
+	return parseUpstreamError(raw)
+}
+
+func isJSONEmpty(raw json.RawMessage) bool {
+	s := strings.TrimSpace(string(raw))
+	return s == "" || s == "null" || s == "false" || s == `""`
+}
+
+// parseUpstreamError 解析字符串或 {code, message, detail} 形式的错误
+func parseUpstreamError(raw json.RawMessage) *UpstreamError {
+	var fields struct {
+		Code    json.RawMessage `json:"code"`
+		Message string          `json:"message"`
+		Detail  string          `json:"detail"`
+	}
+	if json.Unmarshal(raw, &fields) != nil {
+		return &UpstreamError{Message: jsonText(raw)}
+	}
+	e := &UpstreamError{Code: jsonText(fields.Code), Message: fields.Message}
+	if e.Message == "" {
+		e.Message = fields.Detail
+	}
+	if e.Message == "" {
+		e.Message = string(raw)
+	}
+	return e
+}
+
+func (u *UpstreamData) GetEditContent() string {
+	editContent := u.Data.EditContent
+	if editContent == "" {
+		return ""
+	}
+
+	if len(editContent) > 0 && editContent[0] == '"' {
+		var unescaped string
+		if err := json.Unmarshal([]byte(editContent), &unescaped); err == nil {
+			LogDebug("[GetEditContent] Unescaped edit_content from JSON string")
+			return unescaped
+		}
+	}
+
+	return editContent
+}
+
+type ThinkingFilter struct {
+	hasSeenFirstThinking bool
+	buffer               string
+	lastOutputChunk      string
+	lastPhase            string
+	// 已输出过思考内容；新一轮思考的第一段内容前需要输出空行分隔
+	hasOutput        bool
+	separatorPending bool
+}
+
+func (f *ThinkingFilter) ProcessThinking(deltaContent string) string {
+	if !f.hasSeenFirstThinking {
+		f.hasSeenFirstThinking = true
+		if idx := strings.Index(deltaContent, "> "); idx != -1 {
+			deltaContent = deltaContent[idx+2:]
+		} else {
+			return ""
+		}
+	}
+
+	content := f.buffer + deltaContent
+	f.buffer = ""
+
+	content = strings.ReplaceAll(content, "\n> ", "\n")
+
+	if strings.HasSuffix(content, "\n>") {
+		f.buffer = "\n>"
+		return content[:len(content)-2]
+	}
+	if strings.HasSuffix(content, "\n") {
+		f.buffer = "\n"
+		return content[:len(content)-1]
+	}
+
+	return content
+}
+
+func (f *ThinkingFilter) Flush() string {
+	result := f.buffer
+	f.buffer = ""
+	return result
+}
+
+func (f *ThinkingFilter) ExtractCompleteThinking(editContent string) string {
+	startIdx := strings.Index(editContent, "> ")
+	if startIdx == -1 {
+		return ""
+	}
+	startIdx += 2
+
+	endIdx := strings.Index(editContent, "\n</details>")
+	if endIdx == -1 {
+		return ""
+	}
+
+	content := editContent[startIdx:endIdx]
+	content = strings.ReplaceAll(content, "\n> ", "\n")
+	return content
+}
+
+func (f *ThinkingFilter) ExtractIncrementalThinking(editContent string) string {
+	completeThinking := f.ExtractCompleteThinking(editContent)
+	if completeThinking == "" {
+		return ""
+	}
+
+	if f.lastOutputChunk == "" {
+		return completeThinking
+	}
+
+	idx := strings.Index(completeThinking, f.lastOutputChunk)
+	if idx == -1 {
+		return completeThinking
+	}
+
+	incrementalPart := completeThinking[idx+len(f.lastOutputChunk):]
+	return incrementalPart
+}
+
+func (f *ThinkingFilter) ResetForNewRound() {
+	f.lastOutputChunk = ""
+	f.hasSeenFirstThinking = false
+}
+
+// UpstreamEventType 是上游 SSE 归一化后的事件类型
+type UpstreamEventType int
+
+const (
+	// EventReasoning 思考内容增量
+	EventReasoning UpstreamEventType = iota
+	// EventText 正文增量
+	EventText
+	// EventCitations 联网搜索返回的引用来源
+	EventCitations
+	// EventImages 图片搜索结果
+	EventImages
+	// EventToolActivity 上游自行执行的搜索或 MCP 工具调用，不输出给客户端
+	EventToolActivity
+	// EventDone 上游正常结束
+	EventDone
+	// EventError 读取上游失败，如超时
+	EventError
+)
+
+// UpstreamEvent 是从 z.ai SSE 中解析出的一个事件
+type UpstreamEvent struct {
+	Type UpstreamEventType
+	// EventReasoning / EventText 的文本
+	Text      string
+	Citations []SearchResult
+	Images    []ImageSearchResult
+	// EventToolActivity 对应的 glm_block
+	Block *GlmBlock
+	Err   error
+}
+
+// upstreamEventParser 维护阶段切换、思考过滤和 edit_content 的增量状态
+type upstreamEventParser struct {
+	thinking ThinkingFilter
+	blocks   glmBlockParser
+	// 已输出正文的字符数，other / tool_call 阶段的 edit_content 是完整正文，只取新增部分
+	contentLength int
+}
+
+// parse 将一条上游数据转换为零个或多个事件
+func (p *upstreamEventParser) parse(upstream *UpstreamData) []UpstreamEvent {
+	data := upstream.Data
+	if data.Phase == "done" {
+		return []UpstreamEvent{{Type: EventDone}}
+	}
+
+	if data.Phase == "thinking" && data.DeltaContent != "" {
+		return p.parseThinking(data.DeltaContent)
+	}
+
+	var events []UpstreamEvent
+	text := func(t string) {
+		if t != "" {
+			events = append(events, UpstreamEvent{Type: EventText, Text: t})
+		}
+	}
+	reasoning := func(t string) {
+		if t != "" {
+			events = append(events, UpstreamEvent{Type: EventReasoning, Text: t})
+		}
+	}
+
+	if data.Phase != "" {
+		p.thinking.lastPhase = data.Phase
+	}
+	if data.Phase != "thinking" {
+		// 思考阶段结束，输出为匹配 "\n> " 暂存的尾部
+		reasoning(p.thinking.Flush())
+	}
+
+	editContent := upstream.GetEditContent()
+	if p.blocks.partial != "" && !p.blocks.Continues(data.Phase, editContent) {
+		// 未闭合的块没有后续内容，丢弃以免吞掉之后的回答
+		p.blocks.Discard()
+	}
+	if editContent != "" && p.blocks.HasBlock(editContent) {
+		content := p.blocks.Parse(data.Phase, editContent)
+		text(content.Text)
+		for i := range content.Blocks {
+			block := &content.Blocks[i]
+			switch {
+			case len(block.SearchResults) > 0:
+				events = append(events, UpstreamEvent{Type: EventCitations, Citations: block.SearchResults})
+			case len(block.ImageResults) > 0:
+				events = append(events, UpstreamEvent{Type: EventImages, Images: block.ImageResults})
+			default:
+				events = append(events, UpstreamEvent{Type: EventToolActivity, Block: block})
+			}
+		}
+		return events
+	}
+	if strings.Contains(editContent, `"search_result"`) {
+		// 不在 glm_block 中的搜索结果
+		if results := parseLooseSearchResults(editContent); len(results) > 0 {
+			events = append(events, UpstreamEvent{Type: EventCitations, Citations: results})
+		}
+		return events
+	}
+
+	switch {
+	case data.Phase == "answer" && data.DeltaContent != "":
+		p.contentLength += len([]rune(data.DeltaContent))
+		text(data.DeltaContent)
+	case data.Phase == "answer" && editContent != "":
+		// 思考结束时上游发送完整的 <details> 块，其后可能带有正文开头
+		idx := strings.Index(editContent, "</details>")
+		if idx == -1 {
+			break
+		}
+		reasoning(p.thinking.ExtractIncrementalThinking(editContent))
+		content := strings.TrimPrefix(editContent[idx+len("</details>"):], "\n")
+		p.contentLength = len([]rune(content))
+		text(content)
+	case (data.Phase == "other" || data.Phase == "tool_call") && editContent != "":
+		runes := []rune(editContent)
+		if len(runes) > p.contentLength {
+			text(string(runes[p.contentLength:]))
+			p.contentLength = len(runes)
+		} else {
+			text(editContent)
+		}
+	}
+	return events
+}
+
+func (p *upstreamEventParser) parseThinking(delta string) []UpstreamEvent {
+	f := &p.thinking
+	if f.lastPhase != "" && f.lastPhase != "thinking" {
+		f.ResetForNewRound()
+		f.separatorPending = f.hasOutput
+	}
+	f.lastPhase = "thinking"
+
+	reasoning := f.ProcessThinking(delta)
+	if reasoning == "" {
+		return nil
+	}
+	f.lastOutputChunk = reasoning
+	f.hasOutput = true
+	if f.separatorPending {
+		// 新一轮的第一个 delta 通常只有 <details> 头，分隔符在第一段内容前输出
+		f.separatorPending = false
+		reasoning = "\n\n" + reasoning
+	}
+	return []UpstreamEvent{{Type: EventReasoning, Text: reasoning}}
+}
+
+// upstreamEventReader 读取上游 SSE 并按顺序返回事件
+type upstreamEventReader struct {
+	sse      *sseReader
+	parser   upstreamEventParser
+	pending  []UpstreamEvent
+	finished bool
+	// 是否收到过 done 为 true 的事件，此后连接结束视为正常
+	completed bool
+}
+
+func newUpstreamEventReader(body io.Reader) *upstreamEventReader {
+	r := &upstreamEventReader{sse: newSSEReader(body, Cfg.UpstreamMaxEventSize)}
+	r.parser.blocks.maxSize = Cfg.UpstreamMaxEventSize
+	return r
+}
+
+// Next 返回下一个事件，上游结束后总是返回 EventDone 或 EventError；
+// 上游返回错误或在结束标记之前断开时返回 EventError
+func (r *upstreamEventReader) Next() UpstreamEvent {
+	for len(r.pending) == 0 {
+		if r.finished {
+			return UpstreamEvent{Type: EventDone}
+		}
+		sse, err := r.sse.Next()
+		if err != nil {
+			r.finished = true
+			if err == io.EOF && r.completed {
+				return r.done()
+			}
+			if err == io.EOF {
+				// 没有收到结束标记，回答可能不完整
+				err = errUpstreamTruncated
+			}
+			return UpstreamEvent{Type: EventError, Err: err}
+		}
+
+		LogDebug("[Upstream] %s", sse.Data)
+		if sse.Data == "[DONE]" {
+			return r.done()
+		}
+
+		var upstream UpstreamData
+		jsonErr := json.Unmarshal([]byte(sse.Data), &upstream)
+		if sse.Event == "error" {
+			r.finished = true
+			upstreamErr := &UpstreamError{Message: sse.Data}
+			if jsonErr == nil && upstream.GetError() != nil {
+				upstreamErr = upstream.GetError()
+			}
+			return UpstreamEvent{Type: EventError, Err: upstreamErr}
+		}
+		if jsonErr != nil {
+			continue
+		}
+		if upstreamErr := upstream.GetError(); upstreamErr != nil {
+			r.finished = true
+			return UpstreamEvent{Type: EventError, Err: upstreamErr}
+		}
+		if upstream.Data.Done {
+			r.completed = true
+		}
+		r.pending = r.parser.parse(&upstream)
+	}
+
+	event := r.pending[0]
+	r.pending = r.pending[1:]
+	if event.Type == EventDone {
+		return r.done()
+	}
+	return event
+}
+
+// done 结束读取，仍未闭合的 glm_block 不再有后续内容
+func (r *upstreamEventReader) done() UpstreamEvent {
+	r.finished = true
+	r.pending = nil
+	r.parser.blocks.Discard()
+	return UpstreamEvent{Type: EventDone}
+}
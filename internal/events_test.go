@@ -0,0 +1,266 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// sseStream 将上游 data 对象编码为 SSE
+func sseStream(t *testing.T, events ...map[string]interface{}) io.ReadCloser {
+	t.Helper()
+	var sb strings.Builder
+	for _, event := range events {
+		data, err := json.Marshal(map[string]interface{}{"type": "chat:completion", "data": event})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sb.WriteString("data: " + string(data) + "\n\n")
+	}
+	return io.NopCloser(strings.NewReader(sb.String()))
+}
+
+func TestPipelineUnclosedGlmBlock(t *testing.T) {
+	unclosed := testMcpBlock[:60]
+	done := map[string]interface{}{"phase": "done", "done": true}
+	tests := []struct {
+		name   string
+		events []map[string]interface{}
+		want   string
+	}{
+		{
+			name: "unclosed block is dropped and the answer is kept",
+			events: []map[string]interface{}{
+				{"phase": "tool_call", "edit_content": unclosed},
+				{"phase": "answer", "delta_content": "Hello"},
+				{"phase": "answer", "delta_content": " world"},
+				done,
+			},
+			want: "Hello world",
+		},
+		{
+			name: "unclosed block at the end is dropped",
+			events: []map[string]interface{}{
+				{"phase": "answer", "delta_content": "Hi"},
+				{"phase": "other", "edit_content": unclosed},
+				done,
+			},
+			want: "Hi",
+		},
+		{
+			name: "continued block in the same phase",
+			events: []map[string]interface{}{
+				{"phase": "tool_call", "edit_content": testMcpBlock[:60]},
+				{"phase": "tool_call", "edit_content": testMcpBlock[60:]},
+				{"phase": "answer", "delta_content": "Done"},
+				done,
+			},
+			want: "Done",
+		},
+		{
+			name: "search results outside a block",
+			events: []map[string]interface{}{
+				{"phase": "tool_call", "edit_content": `{"search_result": [{"title": "A", "url": "https://a.example", "index": 1, "ref_id": "turn0search0"}]}`},
+				{"phase": "answer", "delta_content": "See【turn0search0】."},
+				done,
+			},
+			want: "[\\[1\\] A](https://a.example)\n\nSee[\\[1\\]](https://a.example).",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := collectResponse(sseStream(t, tt.events...), &responseOptions{}, false)
+			if result.err != nil {
+				t.Fatalf("unexpected error: %v", result.err)
+			}
+			if result.content != tt.want {
+				t.Fatalf("content = %q, want %q", result.content, tt.want)
+			}
+		})
+	}
+}
+
+// parseAll 依次解析上游数据，返回合并后的思考、正文和其他事件类型
+func parseAll(events []map[string]interface{}) (reasoning, text string, others []UpstreamEventType) {
+	var parser upstreamEventParser
+	for _, event := range events {
+		data, _ := json.Marshal(map[string]interface{}{"data": event})
+		var upstream UpstreamData
+		json.Unmarshal(data, &upstream)
+		for _, e := range parser.parse(&upstream) {
+			switch e.Type {
+			case EventReasoning:
+				reasoning += e.Text
+			case EventText:
+				text += e.Text
+			default:
+				others = append(others, e.Type)
+			}
+		}
+	}
+	return reasoning, text, others
+}
+
+func TestUpstreamEventParser(t *testing.T) {
+	tests := []struct {
+		name          string
+		events        []map[string]interface{}
+		wantReasoning string
+		wantText      string
+		wantOthers    []UpstreamEventType
+	}{
+		{
+			name: "answer deltas",
+			events: []map[string]interface{}{
+				{"phase": "answer", "delta_content": "Hello"},
+				{"phase": "answer", "delta_content": " world"},
+			},
+			wantText: "Hello world",
+		},
+		{
+			name: "thinking quotes are removed",
+			events: []map[string]interface{}{
+				{"phase": "thinking", "delta_content": "<details type=\"reasoning\">\n> "},
+				{"phase": "thinking", "delta_content": "line one\n"},
+				{"phase": "thinking", "delta_content": "> line two"},
+				{"phase": "answer", "delta_content": "Answer"},
+			},
+			wantReasoning: "line one\nline two",
+			wantText:      "Answer",
+		},
+		{
+			name: "multiple thinking rounds are separated",
+			events: []map[string]interface{}{
+				{"phase": "thinking", "delta_content": "<details>\n> first"},
+				{"phase": "tool_call", "edit_content": testMcpBlock},
+				{"phase": "thinking", "delta_content": "<details>\n> second"},
+				{"phase": "answer", "delta_content": "ok"},
+			},
+			wantReasoning: "first\n\nsecond",
+			wantText:      "ok",
+			wantOthers:    []UpstreamEventType{EventToolActivity},
+		},
+		{
+			name: "separator waits for content after a header-only delta",
+			events: []map[string]interface{}{
+				{"phase": "tool_call", "edit_content": testMcpBlock},
+				{"phase": "thinking", "delta_content": "<details>\n> "},
+				{"phase": "thinking", "delta_content": "first"},
+				{"phase": "tool_call", "edit_content": testMcpBlock},
+				{"phase": "thinking", "delta_content": "<details>\n> "},
+				{"phase": "thinking", "delta_content": "second"},
+			},
+			wantReasoning: "first\n\nsecond",
+			wantOthers:    []UpstreamEventType{EventToolActivity, EventToolActivity},
+		},
+		{
+			name: "details block completes thinking and starts the answer",
+			events: []map[string]interface{}{
+				{"phase": "thinking", "delta_content": "<details>\n> abc"},
+				{"phase": "answer", "edit_content": "<details>\n> abcdef\n</details>\nStart"},
+				{"phase": "answer", "delta_content": " more"},
+			},
+			wantReasoning: "abcdef",
+			wantText:      "Start more",
+		},
+		{
+			name: "other phase edit_content only adds new text",
+			events: []map[string]interface{}{
+				{"phase": "answer", "delta_content": "Hello"},
+				{"phase": "other", "edit_content": "Hello there"},
+			},
+			wantText: "Hello there",
+		},
+		{
+			name: "search and image blocks",
+			events: []map[string]interface{}{
+				{"phase": "tool_call", "edit_content": testSearchBlock},
+				{"phase": "tool_call", "edit_content": testImageBlock},
+			},
+			wantOthers: []UpstreamEventType{EventCitations, EventImages},
+		},
+		{
+			name: "done phase",
+			events: []map[string]interface{}{
+				{"phase": "done", "done": true},
+			},
+			wantOthers: []UpstreamEventType{EventDone},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reasoning, text, others := parseAll(tt.events)
+			if reasoning != tt.wantReasoning {
+				t.Errorf("reasoning = %q, want %q", reasoning, tt.wantReasoning)
+			}
+			if text != tt.wantText {
+				t.Errorf("text = %q, want %q", text, tt.wantText)
+			}
+			if len(others) != len(tt.wantOthers) {
+				t.Fatalf("events = %v, want %v", others, tt.wantOthers)
+			}
+			for i := range others {
+				if others[i] != tt.wantOthers[i] {
+					t.Errorf("events = %v, want %v", others, tt.wantOthers)
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamEventReaderErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		stream  string
+		want    UpstreamEventType
+		wantErr string
+	}{
+		{"done marker", "data: [DONE]\n\n", EventDone, ""},
+		{"done flag", "data: {\"data\":{\"phase\":\"answer\",\"done\":true}}\n\n", EventDone, ""},
+		{"error in data", "data: {\"type\":\"chat:completion\",\"data\":{\"error\":{\"code\":\"E1\",\"message\":\"boom\"}}}\n\n", EventError, "upstream error E1: boom"},
+		{"error event", "event: error\ndata: {\"detail\":\"bad\"}\n\n", EventError, "upstream error: bad"},
+		{"top-level detail", "data: {\"detail\":\"Unauthorized\"}\n\n", EventError, "upstream error: Unauthorized"},
+		{"no content before disconnect", ": ping\n\n", EventError, errUpstreamTruncated.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := newUpstreamEventReader(strings.NewReader(tt.stream))
+			event := reader.Next()
+			if event.Type != tt.want {
+				t.Fatalf("event = %+v, want type %v", event, tt.want)
+			}
+			if tt.wantErr != "" && (event.Err == nil || event.Err.Error() != tt.wantErr) {
+				t.Fatalf("error = %v, want %q", event.Err, tt.wantErr)
+			}
+			if next := reader.Next(); next.Type != EventDone {
+				t.Fatalf("event after end = %+v", next)
+			}
+		})
+	}
+}
+
+func TestPipelineMissingDoneMarker(t *testing.T) {
+	partial := map[string]interface{}{"phase": "answer", "delta_content": "partial"}
+
+	result := collectResponse(sseStream(t, partial), &responseOptions{}, false)
+	if !errors.Is(result.err, errUpstreamTruncated) {
+		t.Fatalf("non-stream error = %v, want %v", result.err, errUpstreamTruncated)
+	}
+
+	rec := httptest.NewRecorder()
+	handleStreamResponse(rec, sseStream(t, partial), "chatcmpl-test", "test-model", &responseOptions{})
+	body := rec.Body.String()
+	if !strings.Contains(body, `"upstream_truncated"`) || !strings.Contains(body, `"finish_reason":"error"`) || strings.Contains(body, `"finish_reason":"stop"`) {
+		t.Errorf("OpenAI stream did not end with an error:\n%s", body)
+	}
+
+	rec = httptest.NewRecorder()
+	handleClaudeStreamResponse(rec, sseStream(t, partial), "msg_test", "test-model", &responseOptions{})
+	body = rec.Body.String()
+	if !strings.Contains(body, "event: error") || strings.Contains(body, "message_stop") || strings.Contains(body, "end_turn") {
+		t.Errorf("Claude stream did not end with an error:\n%s", body)
+	}
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// parseModelFallbacks 解析 MODEL_FALLBACKS，每项形如 GLM-4.7-thinking->GLM-4.6-thinking->GLM-4.5，
+// 第一个模型为请求的模型，其余为依次尝试的后备模型
+func parseModelFallbacks(chains []string) map[string][]string {
+	fallbacks := make(map[string][]string)
+	for _, chain := range chains {
+		var models []string
+		for _, model := range strings.Split(chain, "->") {
+			if model = strings.TrimSpace(model); model != "" {
+				models = append(models, model)
+			}
+		}
+		if len(models) > 1 {
+			fallbacks[models[0]] = models[1:]
+		}
+	}
+	return fallbacks
+}
+
+// sendWithFallback 依次尝试请求的模型及其后备模型，上游请求失败或返回空流时换用下一个模型，
+// 返回响应、上游模型 ID 和实际使用的模型名。
+// 只有还有后备模型时才预读响应内容，最后一个模型的结果原样返回
+func sendWithFallback(ctx context.Context, lease *tokenLease, messages []Message, model string, images *imageUploads) (*http.Response, string, string, error) {
+	chain := append([]string{model}, Cfg.ModelFallbacks[model]...)
+	for i := 0; ; i++ {
+		candidate := chain[i]
+		resp, targetModel, err := sendUpstream(ctx, lease, messages, candidate, images)
+		if i == len(chain)-1 || err == errInvalidToken || (err != nil && isClientGone(ctx, err)) {
+			return resp, targetModel, candidate, err
+		}
+
+		reason := ""
+		switch {
+		case err != nil:
+			reason = err.Error()
+		case resp.StatusCode != http.StatusOK:
+			reason = http.StatusText(resp.StatusCode)
+			resp.Body.Close()
+		default:
+			ready, err := peekContent(resp)
+			if err == nil && ready {
+				return resp, targetModel, candidate, nil
+			}
+			resp.Body.Close()
+			if err != nil && isClientGone(ctx, err) {
+				return nil, "", candidate, err
+			}
+			reason = "empty response"
+			if err != nil {
+				reason = err.Error()
+			}
+		}
+
+		LogWarn("[Fallback] Model %s failed (%s), falling back to %s", candidate, reason, chain[i+1])
+		metrics.Inc("zai_model_fallbacks_total", "from", candidate, "to", chain[i+1])
+	}
+}
+
+// peekContent 预读上游 SSE，返回是否应把该响应交给客户端：出现第一段内容、上游错误事件或
+// 超过 UPSTREAM_MAX_EVENT_SIZE 的事件时返回 true，流在此之前结束时返回 false 以换用后备模型。
+// 上游错误和过大的事件由响应处理函数告知客户端，不会被后备模型掩盖。
+// 预读的数据会放回响应体，后续处理不受影响
+func peekContent(resp *http.Response) (bool, error) {
+	var peeked bytes.Buffer
+	events := newSSEReader(io.TeeReader(resp.Body, &peeked), Cfg.UpstreamMaxEventSize)
+	ready := false
+peek:
+	for !ready {
+		event, err := events.Next()
+		switch {
+		case err == io.EOF:
+			break peek
+		case errors.Is(err, errSSEEventTooLarge):
+			ready = true
+			continue
+		case err != nil:
+			return false, err
+		}
+
+		var upstream UpstreamData
+		jsonErr := json.Unmarshal([]byte(event.Data), &upstream)
+		switch {
+		case event.Event == "error" || (jsonErr == nil && upstream.GetError() != nil):
+			ready = true
+		case jsonErr != nil:
+		case upstream.Data.DeltaContent != "" || upstream.Data.EditContent != "":
+			ready = true
+		case upstream.Data.Done || upstream.Data.Phase == "done":
+			break peek
+		}
+	}
+	// 解码器读取的数据都已写入 peeked
+	resp.Body = &peekedBody{Reader: io.MultiReader(&peeked, resp.Body), body: resp.Body}
+	return ready, nil
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// fileWatcher 在配置文件的修改时间变化后重新加载，使修改无需重启即可生效
+type fileWatcher struct {
+	path    string
+	load    func(path string) error
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+func newFileWatcher(path string, load func(path string) error) *fileWatcher {
+	return &fileWatcher{path: path, load: load}
+}
+
+// Reload 立即重新加载文件，加载失败时调用方保留之前的配置
+func (fw *fileWatcher) Reload() error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	info, err := os.Stat(fw.path)
+	if err != nil {
+		return err
+	}
+	fw.modTime = info.ModTime()
+	return fw.load(fw.path)
+}
+
+func (fw *fileWatcher) changed() bool {
+	info, err := os.Stat(fw.path)
+	if err != nil {
+		return false
+	}
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return !info.ModTime().Equal(fw.modTime)
+}
+
+// Watch 每隔 interval 检查一次文件，interval 不大于 0 时不检查
+func (fw *fileWatcher) Watch(interval time.Duration, name string) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			if !fw.changed() {
+				continue
+			}
+			if err := fw.Reload(); err != nil {
+				LogError("Failed to reload %s, keeping previous version: %v", name, err)
+			}
+		}
+	}()
+}
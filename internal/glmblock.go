@@ -0,0 +1,283 @@
+package internal
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	glmBlockOpenTag  = "<glm_block"
+	glmBlockCloseTag = "</glm_block>"
+)
+
+var glmBlockViewPattern = regexp.MustCompile(`view="([^"]*)"`)
+
+// GlmBlock 是 edit_content 中 <glm_block> 包裹的 JSON，如上游执行的搜索或 MCP 工具调用
+type GlmBlock struct {
+	// 块类型，如 "mcp"；无法解析的块为空
+	Type string
+	View string
+	// data.metadata 中的工具调用信息
+	Tool          *GlmToolCall
+	SearchResults []SearchResult
+	ImageResults  []ImageSearchResult
+	// 块内的原始 JSON，未知类型的块可以据此处理
+	Raw string
+}
+
+// GlmToolCall 是上游执行的一次工具调用
+type GlmToolCall struct {
+	ID        string
+	Name      string
+	Arguments string
+	Status    string
+	IsError   bool
+	// 工具返回的原始结果，可能是数组或字符串
+	Result json.RawMessage
+}
+
+// GlmContent 是拆分后的 edit_content
+type GlmContent struct {
+	// 块之外的文本
+	Text   string
+	Blocks []GlmBlock
+}
+
+// glmBlockParser 解析 edit_content 中的 glm_block。
+// 未闭合的块暂存到同一阶段的下一次 edit_content，没有后续内容、超过 maxSize 或流结束时丢弃
+type glmBlockParser struct {
+	partial string
+	// 暂存块所在的阶段
+	partialPhase string
+	// 暂存块允许的最大字节数，<= 0 表示不限制
+	maxSize int
+}
+
+// HasBlock 判断 edit_content 是否包含 glm_block 或是此前未闭合块的后续部分
+func (p *glmBlockParser) HasBlock(content string) bool {
+	return p.partial != "" || strings.Contains(content, glmBlockOpenTag)
+}
+
+// Continues 判断 phase 阶段的 edit_content 是否可能是暂存块的后续部分
+func (p *glmBlockParser) Continues(phase, content string) bool {
+	return content != "" && phase == p.partialPhase
+}
+
+// Discard 丢弃暂存的未闭合块，上游标记不能作为正文输出给客户端
+func (p *glmBlockParser) Discard() {
+	if p.partial != "" {
+		LogWarn("[GlmBlock] Unclosed block dropped: %s", p.partial[:min(200, len(p.partial))])
+	}
+	p.partial, p.partialPhase = "", ""
+}
+
+func (p *glmBlockParser) Parse(phase, content string) GlmContent {
+	if p.partial != "" {
+		// 上游重新发送了完整的块时丢弃暂存的部分
+		if !strings.HasPrefix(strings.TrimSpace(content), glmBlockOpenTag) {
+			content = p.partial + content
+		}
+		p.partial, p.partialPhase = "", ""
+	}
+
+	var result GlmContent
+	var text strings.Builder
+	for {
+		start := strings.Index(content, glmBlockOpenTag)
+		if start == -1 {
+			text.WriteString(content)
+			break
+		}
+		// 块前用于换行的 "\n" 不输出
+		text.WriteString(strings.TrimSuffix(content[:start], "\n"))
+
+		block, n, ok := parseGlmBlock(content[start:])
+		if !ok {
+			if p.maxSize > 0 && len(content)-start > p.maxSize {
+				LogWarn("[GlmBlock] Unclosed block exceeds %d bytes, dropped", p.maxSize)
+				break
+			}
+			p.partial, p.partialPhase = content[start:], phase
+			break
+		}
+		result.Blocks = append(result.Blocks, block)
+		content = content[start+n:]
+	}
+	result.Text = text.String()
+	return result
+}
+
+// parseGlmBlock 解析以 <glm_block 开头的字符串，返回块和消耗的长度，块不完整时 ok 为 false
+func parseGlmBlock(s string) (block GlmBlock, n int, ok bool) {
+	tagEnd := strings.Index(s, ">")
+	if tagEnd == -1 {
+		return GlmBlock{}, 0, false
+	}
+	if m := glmBlockViewPattern.FindStringSubmatch(s[:tagEnd]); m != nil {
+		block.View = m[1]
+	}
+	body := s[tagEnd+1:]
+
+	// 用 JSON 解码器确定块内 JSON 的结束位置，字符串中的括号和结束标签不会干扰
+	decoder := json.NewDecoder(strings.NewReader(body))
+	var raw json.RawMessage
+	if err := decoder.Decode(&raw); err == nil {
+		offset := int(decoder.InputOffset())
+		rest := strings.TrimLeft(body[offset:], " \t\r\n")
+		if rest == "" {
+			return GlmBlock{}, 0, false
+		}
+		if strings.HasPrefix(rest, glmBlockCloseTag) {
+			decodeGlmBlock(&block, raw)
+			return block, len(s) - len(rest) + len(glmBlockCloseTag), true
+		}
+	}
+
+	// JSON 不完整或无法解析：有结束标签时作为未知块跳过，否则等待后续内容
+	end := strings.Index(body, glmBlockCloseTag)
+	if end == -1 {
+		return GlmBlock{}, 0, false
+	}
+	block.Raw = body[:end]
+	LogDebug("[GlmBlock] Failed to parse block: %s", block.Raw[:min(200, len(block.Raw))])
+	return block, tagEnd + 1 + end + len(glmBlockCloseTag), true
+}
+
+type glmBlockEnvelope struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+	// 搜索结果可能位于顶层、data 或 data.metadata 中
+	SearchResult json.RawMessage `json:"search_result"`
+}
+
+type glmBlockData struct {
+	Metadata     json.RawMessage `json:"metadata"`
+	SearchResult json.RawMessage `json:"search_result"`
+}
+
+type glmToolMetadata struct {
+	ID           string          `json:"id"`
+	Name         string          `json:"name"`
+	Arguments    json.RawMessage `json:"arguments"`
+	Status       string          `json:"status"`
+	IsError      bool            `json:"is_error"`
+	Result       json.RawMessage `json:"result"`
+	SearchResult json.RawMessage `json:"search_result"`
+}
+
+func decodeGlmBlock(block *GlmBlock, raw json.RawMessage) {
+	// 块内容可能被再次编码为 JSON 字符串
+	raw = unwrapJSONString(raw)
+	block.Raw = string(raw)
+
+	var envelope glmBlockEnvelope
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return
+	}
+	block.Type = envelope.Type
+	block.SearchResults = append(block.SearchResults, parseSearchResultList(envelope.SearchResult)...)
+
+	var data glmBlockData
+	if json.Unmarshal(unwrapJSONString(envelope.Data), &data) != nil {
+		return
+	}
+	block.SearchResults = append(block.SearchResults, parseSearchResultList(data.SearchResult)...)
+
+	var meta glmToolMetadata
+	if len(data.Metadata) == 0 || json.Unmarshal(unwrapJSONString(data.Metadata), &meta) != nil {
+		return
+	}
+	block.Tool = &GlmToolCall{
+		ID:        meta.ID,
+		Name:      meta.Name,
+		Arguments: jsonText(meta.Arguments),
+		Status:    meta.Status,
+		IsError:   meta.IsError,
+		Result:    meta.Result,
+	}
+	block.SearchResults = append(block.SearchResults, parseSearchResultList(meta.SearchResult)...)
+	// 与解析为块之前的判断一致：块中出现 "search_image" 即为图片搜索
+	if strings.Contains(block.Raw, `"search_image"`) {
+		block.ImageResults = parseImageResultList(meta.Result)
+	}
+}
+
+// unwrapJSONString 在值是 JSON 字符串时返回其内容，否则原样返回
+func unwrapJSONString(raw json.RawMessage) json.RawMessage {
+	var s string
+	if len(raw) > 0 && raw[0] == '"' && json.Unmarshal(raw, &s) == nil {
+		return json.RawMessage(s)
+	}
+	return raw
+}
+
+// jsonText 返回字符串的值，其他类型返回紧凑的 JSON
+func jsonText(raw json.RawMessage) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	return compactJSON(raw)
+}
+
+func parseSearchResultList(raw json.RawMessage) []SearchResult {
+	var items []struct {
+		Title string          `json:"title"`
+		URL   string          `json:"url"`
+		Index json.RawMessage `json:"index"`
+		RefID string          `json:"ref_id"`
+	}
+	if len(raw) == 0 || json.Unmarshal(unwrapJSONString(raw), &items) != nil {
+		return nil
+	}
+	var results []SearchResult
+	for _, item := range items {
+		// index 可能是数字或字符串
+		index, _ := strconv.Atoi(strings.Trim(string(item.Index), `"`))
+		results = append(results, SearchResult{Title: item.Title, URL: item.URL, Index: index, RefID: item.RefID})
+	}
+	return results
+}
+
+// parseLooseSearchResults 解析 glm_block 之外出现的 "search_result": [...]
+func parseLooseSearchResults(content string) []SearchResult {
+	const key = `"search_result"`
+	idx := strings.Index(content, key)
+	if idx == -1 {
+		return nil
+	}
+	rest := strings.TrimLeft(content[idx+len(key):], " \t\r\n")
+	if !strings.HasPrefix(rest, ":") {
+		return nil
+	}
+	var raw json.RawMessage
+	if json.NewDecoder(strings.NewReader(rest[1:])).Decode(&raw) != nil {
+		return nil
+	}
+	return parseSearchResultList(raw)
+}
+
+func parseImageResultList(raw json.RawMessage) []ImageSearchResult {
+	var items []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if len(raw) == 0 || json.Unmarshal(unwrapJSONString(raw), &items) != nil {
+		return nil
+	}
+	var results []ImageSearchResult
+	for _, item := range items {
+		if item.Type != "text" {
+			continue
+		}
+		if result := parseImageSearchText(item.Text); result.Title != "" && result.Link != "" {
+			results = append(results, result)
+		}
+	}
+	return results
+}
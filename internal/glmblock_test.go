@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	testMcpBlock    = `<glm_block view="">{"type": "mcp", "data": {"metadata": {"id": "call_1", "name": "search", "arguments": "{\"q\":\"go\"}", "status": "completed"}}}</glm_block>`
+	testSearchBlock = `<glm_block view="">{"type": "mcp", "data": {"metadata": {"name": "search"}}, "search_result": [{"title": "One", "url": "https://a.example", "index": 1, "ref_id": "turn0search0"}, {"title": "Two", "url": "https://b.example", "index": "2"}]}</glm_block>`
+	testImageBlock  = `<glm_block view="image">{"type": "mcp", "data": {"metadata": {"name": "search_image", "result": [{"type": "text", "text": "Title: Cat; Link: https://img.example/cat.png; Thumbnail: https://img.example/t.png"}]}}}</glm_block>`
+)
+
+func TestGlmBlockParser(t *testing.T) {
+	tests := []struct {
+		name        string
+		chunks      []string
+		wantText    string
+		wantBlocks  int
+		wantPartial bool
+	}{
+		{"text only", []string{"hello"}, "hello", 0, false},
+		{"single block", []string{testMcpBlock}, "", 1, false},
+		{"text around block", []string{"Intro\n" + testMcpBlock + "tail"}, "Introtail", 1, false},
+		{"two blocks", []string{testMcpBlock + testSearchBlock}, "", 2, false},
+		{"block split across events", []string{testMcpBlock[:40], testMcpBlock[40:]}, "", 1, false},
+		{"open tag split across events", []string{"<glm_block vi", testMcpBlock[len("<glm_block vi"):]}, "", 1, false},
+		{"close tag inside a JSON string", []string{`<glm_block>{"type": "mcp", "note": "</glm_block>"}</glm_block>after`}, "after", 1, false},
+		{"double-encoded JSON", []string{`<glm_block>"{\"type\": \"mcp\"}"</glm_block>`}, "", 1, false},
+		{"invalid JSON is skipped", []string{`<glm_block>{not json}</glm_block>x`}, "x", 1, false},
+		{"unclosed block", []string{"before\n" + testMcpBlock[:50]}, "before", 0, true},
+		{"resent block replaces partial", []string{testMcpBlock[:50], testMcpBlock}, "", 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var parser glmBlockParser
+			var text strings.Builder
+			blocks := 0
+			for _, chunk := range tt.chunks {
+				if !parser.HasBlock(chunk) {
+					text.WriteString(chunk)
+					continue
+				}
+				content := parser.Parse("tool_call", chunk)
+				text.WriteString(content.Text)
+				blocks += len(content.Blocks)
+			}
+			if text.String() != tt.wantText {
+				t.Errorf("text = %q, want %q", text.String(), tt.wantText)
+			}
+			if blocks != tt.wantBlocks {
+				t.Errorf("got %d blocks, want %d", blocks, tt.wantBlocks)
+			}
+			if (parser.partial != "") != tt.wantPartial {
+				t.Errorf("partial = %q", parser.partial)
+			}
+		})
+	}
+}
+
+func TestGlmBlockParserPartialLimits(t *testing.T) {
+	parser := glmBlockParser{maxSize: 20}
+	content := parser.Parse("tool_call", "a"+testMcpBlock[:60])
+	if content.Text != "a" || parser.partial != "" {
+		t.Fatalf("oversized partial: text = %q, partial = %q", content.Text, parser.partial)
+	}
+
+	parser = glmBlockParser{}
+	parser.Parse("tool_call", testMcpBlock[:30])
+	if parser.Continues("answer", "next") || parser.Continues("tool_call", "") || !parser.Continues("tool_call", "more") {
+		t.Fatalf("unexpected Continues result")
+	}
+	parser.Discard()
+	if parser.partial != "" || parser.HasBlock("plain") {
+		t.Fatalf("partial after Discard = %q", parser.partial)
+	}
+}
+
+func TestDecodeGlmBlock(t *testing.T) {
+	var parser glmBlockParser
+
+	mcp := parser.Parse("tool_call", testMcpBlock).Blocks[0]
+	if mcp.Type != "mcp" || mcp.Tool == nil || mcp.Tool.Name != "search" || mcp.Tool.Arguments != `{"q":"go"}` || mcp.Tool.ID != "call_1" {
+		t.Errorf("mcp block = %+v, tool = %+v", mcp, mcp.Tool)
+	}
+
+	search := parser.Parse("tool_call", testSearchBlock).Blocks[0]
+	if len(search.SearchResults) != 2 {
+		t.Fatalf("got %d search results, want 2", len(search.SearchResults))
+	}
+	if r := search.SearchResults[1]; r.Index != 2 || r.RefID != "" || r.URL != "https://b.example" {
+		t.Errorf("result without ref_id = %+v", r)
+	}
+
+	image := parser.Parse("tool_call", testImageBlock).Blocks[0]
+	if len(image.ImageResults) != 1 || image.ImageResults[0].Link != "https://img.example/cat.png" || image.View != "image" {
+		t.Errorf("image block = %+v", image)
+	}
+
+	// 工具名包含 image 但不是 search_image 时不作为图片搜索
+	other := parser.Parse("tool_call", strings.Replace(testImageBlock, "search_image", "image_caption", 1)).Blocks[0]
+	if len(other.ImageResults) != 0 {
+		t.Errorf("image_caption parsed as image search: %+v", other.ImageResults)
+	}
+}
+
+func TestParseLooseSearchResults(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    int
+	}{
+		{"no results", `{"type": "mcp"}`, 0},
+		{"results outside a block", `{"search_result": [{"title": "A", "url": "https://a.example", "index": 1, "ref_id": "r0"}]}`, 1},
+		{"whitespace before colon", `"search_result" : [{"title": "A", "url": "u"}, {"title": "B", "url": "v"}]`, 2},
+		{"truncated array", `"search_result": [{"title": "A"`, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseLooseSearchResults(tt.content); len(got) != tt.want {
+				t.Fatalf("got %d results, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"zai-proxy/internal/zaistub"
+)
+
+// startStub 启动 zai-stub 并将上游指向它，测试结束后恢复配置
+func startStub(t *testing.T) string {
+	t.Helper()
+	stub := httptest.NewServer(zaistub.NewServer(nil, 0).Handler())
+	saved := *Cfg
+	t.Cleanup(func() {
+		*Cfg = saved
+		stub.Close()
+	})
+	Cfg.UpstreamBaseURL = stub.URL
+	Cfg.AllowRawTokens = true
+	Cfg.UpstreamConnectTimeout = 5 * time.Second
+	Cfg.UpstreamFirstByteTimeout = 5 * time.Second
+	Cfg.UpstreamIdleTimeout = 5 * time.Second
+	return zaistub.NewToken("stub-user", time.Hour)
+}
+
+func TestStubIntegration(t *testing.T) {
+	token := startStub(t)
+	tests := []struct {
+		scenario string
+		stream   bool
+		// OpenAI 和 Claude 响应的状态码及必须包含、不能包含的片段
+		openAIStatus int
+		openAIWant   []string
+		openAIReject []string
+		claudeStatus int
+		claudeWant   []string
+		claudeReject []string
+	}{
+		{
+			scenario:     "answer",
+			openAIStatus: http.StatusOK,
+			openAIWant:   []string{`"content":"This is a stub reply to: stub:answer"`, `"finish_reason":"stop"`},
+			claudeStatus: http.StatusOK,
+			claudeWant:   []string{`"text":"This is a stub reply to: stub:answer"`, `"stop_reason":"end_turn"`},
+		},
+		{
+			scenario:     "answer",
+			stream:       true,
+			openAIStatus: http.StatusOK,
+			openAIWant:   []string{`"content":"stub:answer"`, `"finish_reason":"stop"`, "data: [DONE]"},
+			claudeStatus: http.StatusOK,
+			claudeWant:   []string{`"text":"stub:answer"`, `"stop_reason":"end_turn"`, "event: message_stop"},
+		},
+		{
+			scenario:     "error",
+			openAIStatus: http.StatusBadGateway,
+			openAIWant:   []string{`"code":"upstream_error"`, "stub upstream error"},
+			claudeStatus: http.StatusBadGateway,
+			claudeWant:   []string{`"type":"error"`, "stub upstream error"},
+		},
+		{
+			scenario:     "error",
+			stream:       true,
+			openAIStatus: http.StatusOK,
+			openAIWant:   []string{`"content":"interrupted "`, `"code":"upstream_error"`, `"finish_reason":"error"`},
+			openAIReject: []string{`"finish_reason":"stop"`},
+			claudeStatus: http.StatusOK,
+			claudeWant:   []string{`"text":"interrupted "`, "event: error"},
+			claudeReject: []string{"end_turn", "message_stop"},
+		},
+		{
+			scenario:     "truncated",
+			openAIStatus: http.StatusBadGateway,
+			openAIWant:   []string{`"code":"upstream_truncated"`},
+			claudeStatus: http.StatusBadGateway,
+			claudeWant:   []string{`"type":"error"`},
+		},
+		{
+			scenario:     "truncated",
+			stream:       true,
+			openAIStatus: http.StatusOK,
+			openAIWant:   []string{`"content":"off "`, `"code":"upstream_truncated"`, `"finish_reason":"error"`},
+			openAIReject: []string{`"finish_reason":"stop"`},
+			claudeStatus: http.StatusOK,
+			claudeWant:   []string{`"text":"off "`, "event: error"},
+			claudeReject: []string{"end_turn", "message_stop"},
+		},
+		{
+			scenario:     "empty",
+			openAIStatus: http.StatusOK,
+			openAIWant:   []string{`"content":""`, `"finish_reason":"stop"`},
+			claudeStatus: http.StatusOK,
+			claudeWant:   []string{`"output_tokens":0`, `"stop_reason":"end_turn"`},
+		},
+		{
+			scenario:     "empty",
+			stream:       true,
+			openAIStatus: http.StatusOK,
+			openAIWant:   []string{`"finish_reason":"stop"`, "data: [DONE]"},
+			openAIReject: []string{`"content"`},
+			claudeStatus: http.StatusOK,
+			claudeWant:   []string{"event: message_stop"},
+			claudeReject: []string{"text_delta"},
+		},
+	}
+	for _, tt := range tests {
+		name := tt.scenario
+		if tt.stream {
+			name += "/stream"
+		}
+		t.Run(name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"model": "GLM-4.6", "stream": %v, "messages": [{"role": "user", "content": "stub:%s"}]}`, tt.stream, tt.scenario)
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			HandleChatCompletions(rec, req)
+			checkResponse(t, "OpenAI", rec, tt.openAIStatus, tt.openAIWant, tt.openAIReject)
+
+			body = fmt.Sprintf(`{"model": "claude-sonnet-4", "max_tokens": 1024, "stream": %v, "messages": [{"role": "user", "content": "stub:%s"}]}`, tt.stream, tt.scenario)
+			req = httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+			req.Header.Set("x-api-key", token)
+			rec = httptest.NewRecorder()
+			HandleClaudeChatCompletions(rec, req)
+			checkResponse(t, "Claude", rec, tt.claudeStatus, tt.claudeWant, tt.claudeReject)
+		})
+	}
+}
+
+func checkResponse(t *testing.T, api string, rec *httptest.ResponseRecorder, status int, want, reject []string) {
+	t.Helper()
+	body := rec.Body.String()
+	if rec.Code != status {
+		t.Errorf("%s status = %d, want %d\n%s", api, rec.Code, status, body)
+		return
+	}
+	for _, s := range want {
+		if !strings.Contains(body, s) {
+			t.Errorf("%s response does not contain %s\n%s", api, s, body)
+		}
+	}
+	for _, s := range reject {
+		if strings.Contains(body, s) {
+			t.Errorf("%s response contains %s\n%s", api, s, body)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// JSONSchema 是 JSON Schema 的常用子集，覆盖 OpenAI structured outputs 支持的关键字
+type JSONSchema struct {
+	Type                 interface{}            `json:"type,omitempty"` // string 或 []string
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties interface{}            `json:"additionalProperties,omitempty"` // bool 或 schema
+	Items                *JSONSchema            `json:"items,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Const                interface{}            `json:"const,omitempty"`
+	AnyOf                []*JSONSchema          `json:"anyOf,omitempty"`
+	OneOf                []*JSONSchema          `json:"oneOf,omitempty"`
+	AllOf                []*JSONSchema          `json:"allOf,omitempty"`
+	Ref                  string                 `json:"$ref,omitempty"`
+	Defs                 map[string]*JSONSchema `json:"$defs,omitempty"`
+	Definitions          map[string]*JSONSchema `json:"definitions,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+	ExclusiveMinimum     *float64               `json:"exclusiveMinimum,omitempty"`
+	ExclusiveMaximum     *float64               `json:"exclusiveMaximum,omitempty"`
+	MinItems             *int                   `json:"minItems,omitempty"`
+	MaxItems             *int                   `json:"maxItems,omitempty"`
+
+	// 解析时预先编译的 pattern 和 additionalProperties 子 schema
+	patternRegexp    *regexp.Regexp
+	additionalSchema *JSONSchema
+}
+
+// ParseJSONSchema 解析 schema 并预编译 pattern，pattern 无效时返回错误
+func ParseJSONSchema(raw json.RawMessage) (*JSONSchema, error) {
+	var schema JSONSchema
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return nil, err
+	}
+	if err := schema.compile("$"); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// compile 递归编译 pattern 并解码 additionalProperties，path 用于错误信息
+func (s *JSONSchema) compile(path string) error {
+	if s == nil {
+		return nil
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid pattern %q: %v", path, s.Pattern, err)
+		}
+		s.patternRegexp = re
+	}
+	if additional, ok := s.AdditionalProperties.(map[string]interface{}); ok {
+		data, _ := json.Marshal(additional)
+		var sub JSONSchema
+		if err := json.Unmarshal(data, &sub); err != nil {
+			return fmt.Errorf("%s: invalid additionalProperties schema: %v", path, err)
+		}
+		s.additionalSchema = &sub
+		if err := sub.compile(path + ".additionalProperties"); err != nil {
+			return err
+		}
+	}
+
+	for name, prop := range s.Properties {
+		if err := prop.compile(path + ".properties." + name); err != nil {
+			return err
+		}
+	}
+	if err := s.Items.compile(path + ".items"); err != nil {
+		return err
+	}
+	for keyword, subs := range map[string][]*JSONSchema{"anyOf": s.AnyOf, "oneOf": s.OneOf, "allOf": s.AllOf} {
+		for i, sub := range subs {
+			if err := sub.compile(fmt.Sprintf("%s.%s[%d]", path, keyword, i)); err != nil {
+				return err
+			}
+		}
+	}
+	for keyword, defs := range map[string]map[string]*JSONSchema{"$defs": s.Defs, "definitions": s.Definitions} {
+		for name, def := range defs {
+			if err := def.compile(path + "." + keyword + "." + name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Validate 校验 value（json.Unmarshal 得到的值）是否满足 schema
+func (s *JSONSchema) Validate(value interface{}) error {
+	return s.validate(value, "$", s)
+}
+
+func (s *JSONSchema) resolveRef(root *JSONSchema) (*JSONSchema, error) {
+	ref := s.Ref
+	for _, prefix := range []string{"#/$defs/", "#/definitions/"} {
+		if strings.HasPrefix(ref, prefix) {
+			name := strings.TrimPrefix(ref, prefix)
+			if def, ok := root.Defs[name]; ok {
+				return def, nil
+			}
+			if def, ok := root.Definitions[name]; ok {
+				return def, nil
+			}
+		}
+	}
+	if ref == "#" {
+		return root, nil
+	}
+	return nil, fmt.Errorf("unresolvable $ref %q", ref)
+}
+
+func (s *JSONSchema) validate(value interface{}, path string, root *JSONSchema) error {
+	if s == nil {
+		return nil
+	}
+	if s.Ref != "" {
+		target, err := s.resolveRef(root)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		return target.validate(value, path, root)
+	}
+
+	if types := s.types(); len(types) > 0 {
+		matched := false
+		for _, t := range types {
+			if jsonTypeMatches(t, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(types, " or "), jsonTypeName(value))
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if jsonEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value is not one of the allowed enum values", path)
+		}
+	}
+	if s.Const != nil && !jsonEqual(s.Const, value) {
+		return fmt.Errorf("%s: value does not match const", path)
+	}
+
+	for _, sub := range s.AllOf {
+		if err := sub.validate(value, path, root); err != nil {
+			return err
+		}
+	}
+	if len(s.AnyOf) > 0 {
+		var firstErr error
+		matched := false
+		for _, sub := range s.AnyOf {
+			if err := sub.validate(value, path, root); err == nil {
+				matched = true
+				break
+			} else if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: value does not match any schema in anyOf (%v)", path, firstErr)
+		}
+	}
+	if len(s.OneOf) > 0 {
+		count := 0
+		for _, sub := range s.OneOf {
+			if sub.validate(value, path, root) == nil {
+				count++
+			}
+		}
+		if count != 1 {
+			return fmt.Errorf("%s: value matches %d schemas in oneOf, expected exactly 1", path, count)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return s.validateObject(v, path, root)
+	case []interface{}:
+		return s.validateArray(v, path, root)
+	case string:
+		return s.validateString(v, path)
+	case float64:
+		return s.validateNumber(v, path)
+	}
+	return nil
+}
+
+func (s *JSONSchema) validateObject(obj map[string]interface{}, path string, root *JSONSchema) error {
+	for _, name := range s.Required {
+		if _, ok := obj[name]; !ok {
+			return fmt.Errorf("%s: missing required property %q", path, name)
+		}
+	}
+	for name, value := range obj {
+		childPath := path + "." + name
+		if prop, ok := s.Properties[name]; ok {
+			if err := prop.validate(value, childPath, root); err != nil {
+				return err
+			}
+			continue
+		}
+		if additional, ok := s.AdditionalProperties.(bool); ok && !additional {
+			return fmt.Errorf("%s: additional property %q is not allowed", path, name)
+		}
+		if err := s.additionalSchema.validate(value, childPath, root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *JSONSchema) validateArray(arr []interface{}, path string, root *JSONSchema) error {
+	if s.MinItems != nil && len(arr) < *s.MinItems {
+		return fmt.Errorf("%s: expected at least %d items, got %d", path, *s.MinItems, len(arr))
+	}
+	if s.MaxItems != nil && len(arr) > *s.MaxItems {
+		return fmt.Errorf("%s: expected at most %d items, got %d", path, *s.MaxItems, len(arr))
+	}
+	if s.Items != nil {
+		for i, item := range arr {
+			if err := s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i), root); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *JSONSchema) validateString(str string, path string) error {
+	length := utf8.RuneCountInString(str)
+	if s.MinLength != nil && length < *s.MinLength {
+		return fmt.Errorf("%s: string shorter than %d", path, *s.MinLength)
+	}
+	if s.MaxLength != nil && length > *s.MaxLength {
+		return fmt.Errorf("%s: string longer than %d", path, *s.MaxLength)
+	}
+	if s.patternRegexp != nil && !s.patternRegexp.MatchString(str) {
+		return fmt.Errorf("%s: string does not match pattern %q", path, s.Pattern)
+	}
+	return nil
+}
+
+func (s *JSONSchema) validateNumber(num float64, path string) error {
+	if s.Minimum != nil && num < *s.Minimum {
+		return fmt.Errorf("%s: %v is less than minimum %v", path, num, *s.Minimum)
+	}
+	if s.Maximum != nil && num > *s.Maximum {
+		return fmt.Errorf("%s: %v is greater than maximum %v", path, num, *s.Maximum)
+	}
+	if s.ExclusiveMinimum != nil && num <= *s.ExclusiveMinimum {
+		return fmt.Errorf("%s: %v must be greater than %v", path, num, *s.ExclusiveMinimum)
+	}
+	if s.ExclusiveMaximum != nil && num >= *s.ExclusiveMaximum {
+		return fmt.Errorf("%s: %v must be less than %v", path, num, *s.ExclusiveMaximum)
+	}
+	return nil
+}
+
+func (s *JSONSchema) types() []string {
+	switch t := s.Type.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		var types []string
+		for _, item := range t {
+			if name, ok := item.(string); ok {
+				types = append(types, name)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func jsonTypeMatches(schemaType string, value interface{}) bool {
+	switch schemaType {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		num, ok := value.(float64)
+		return ok && num == math.Trunc(num)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return true
+}
+
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	}
+	return "unknown"
+}
+
+func jsonEqual(a, b interface{}) bool {
+	dataA, errA := json.Marshal(a)
+	dataB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(dataA) == string(dataB)
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseJSONSchemaRejectsInvalidPattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		wantErr string
+	}{
+		{"valid pattern", `{"type":"string","pattern":"^[a-z]+$"}`, ""},
+		{"invalid top-level pattern", `{"type":"string","pattern":"[a-z"}`, "$: invalid pattern"},
+		{"invalid nested pattern", `{"type":"object","properties":{"id":{"type":"string","pattern":"(?<x"}}}`, "$.properties.id: invalid pattern"},
+		{"invalid pattern in items", `{"type":"array","items":{"pattern":"*"}}`, "$.items: invalid pattern"},
+		{"invalid pattern in anyOf", `{"anyOf":[{"type":"number"},{"pattern":"("}]}`, "$.anyOf[1]: invalid pattern"},
+		{"invalid pattern in $defs", `{"$defs":{"code":{"pattern":"a{2,1}"}}}`, "$.$defs.code: invalid pattern"},
+		{"invalid pattern in additionalProperties", `{"type":"object","additionalProperties":{"pattern":"["}}`, "$.additionalProperties: invalid pattern"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseJSONSchema(json.RawMessage(tt.schema))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJSONSchemaValidate(t *testing.T) {
+	const personSchema = `{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1, "pattern": "^[A-Z]"},
+			"age": {"type": "integer", "minimum": 0},
+			"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2},
+			"pet": {"$ref": "#/$defs/pet"}
+		},
+		"required": ["name"],
+		"additionalProperties": false,
+		"$defs": {"pet": {"type": "string", "enum": ["cat", "dog"]}}
+	}`
+	const mapSchema = `{"type":"object","additionalProperties":{"type":"integer","maximum":10}}`
+
+	tests := []struct {
+		name    string
+		schema  string
+		value   string
+		wantErr string
+	}{
+		{"valid object", personSchema, `{"name":"Ann","age":3,"tags":["a"],"pet":"cat"}`, ""},
+		{"missing required", personSchema, `{"age":3}`, `missing required property "name"`},
+		{"pattern mismatch", personSchema, `{"name":"ann"}`, "does not match pattern"},
+		{"not an integer", personSchema, `{"name":"Ann","age":1.5}`, "$.age: expected integer"},
+		{"below minimum", personSchema, `{"name":"Ann","age":-1}`, "less than minimum"},
+		{"too many items", personSchema, `{"name":"Ann","tags":["a","b","c"]}`, "at most 2 items"},
+		{"enum via ref", personSchema, `{"name":"Ann","pet":"fish"}`, "$.pet: value is not one of"},
+		{"additional property rejected", personSchema, `{"name":"Ann","extra":1}`, `additional property "extra"`},
+		{"additional properties schema", mapSchema, `{"a":1,"b":10}`, ""},
+		{"additional properties schema violated", mapSchema, `{"a":1,"b":11}`, "$.b: 11 is greater than maximum"},
+		{"oneOf ambiguous", `{"oneOf":[{"type":"number"},{"type":"integer"}]}`, `1`, "matches 2 schemas in oneOf"},
+		{"anyOf matched", `{"anyOf":[{"type":"string"},{"type":"null"}]}`, `null`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema, err := ParseJSONSchema(json.RawMessage(tt.schema))
+			if err != nil {
+				t.Fatalf("ParseJSONSchema: %v", err)
+			}
+			var value interface{}
+			if err := json.Unmarshal([]byte(tt.value), &value); err != nil {
+				t.Fatalf("invalid test value: %v", err)
+			}
+			err = schema.Validate(value)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
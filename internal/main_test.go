@@ -0,0 +1,15 @@
+package internal
+
+import (
+	"os"
+	"testing"
+)
+
+// 测试使用固定的默认配置，不读取环境变量和 .env
+func TestMain(m *testing.M) {
+	Cfg = &Config{
+		UpstreamMaxEventSize: 16 << 20,
+		JSONMaxRetries:       1,
+	}
+	os.Exit(m.Run())
+}
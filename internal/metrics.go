@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics 是进程内的计数器集合，以 Prometheus 文本格式导出
+type Metrics struct {
+	mu       sync.Mutex
+	counters map[string]int64
+}
+
+var metrics = &Metrics{counters: make(map[string]int64)}
+
+// Inc 计数器加一，labels 为 key, value 交替排列
+func (m *Metrics) Inc(name string, labels ...string) {
+	m.Add(name, 1, labels...)
+}
+
+func (m *Metrics) Add(name string, delta int64, labels ...string) {
+	key := name
+	if len(labels) > 0 {
+		var pairs []string
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+		}
+		key += "{" + strings.Join(pairs, ",") + "}"
+	}
+	m.mu.Lock()
+	m.counters[key] += delta
+	m.mu.Unlock()
+}
+
+// HandleMetrics 以 Prometheus 文本格式输出所有计数器
+func HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(w, r) {
+		return
+	}
+
+	metrics.mu.Lock()
+	keys := make([]string, 0, len(metrics.counters))
+	for k := range metrics.counters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	lastName := ""
+	for _, k := range keys {
+		name := k
+		if idx := strings.Index(k, "{"); idx != -1 {
+			name = k[:idx]
+		}
+		if name != lastName {
+			fmt.Fprintf(w, "# TYPE %s counter\n", name)
+			lastName = name
+		}
+		fmt.Fprintf(w, "%s %d\n", k, metrics.counters[k])
+	}
+	metrics.mu.Unlock()
+}
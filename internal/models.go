@@ -1,37 +1,11 @@
 package internal
 
 import (
-	"encoding/json"
 	"fmt"
 	"regexp"
 	"strings"
 )
 
-// 基础模型映射（不包含标签后缀）
-var BaseModelMapping = map[string]string{
-	"GLM-4.5":      "0727-360B-API",
-	"GLM-4.6":      "GLM-4-6-API-V1",
-	"GLM-4.7":      "glm-4.7",
-	"GLM-4.5-V":    "glm-4.5v",
-	"GLM-4.6-V":    "glm-4.6v",
-	"GLM-4.5-Air":  "0727-106B-API",
-	"0808-360B-DR": "0808-360B-DR",
-}
-
-// v1/models 返回的模型列表（不包含所有标签组合）
-var ModelList = []string{
-	"GLM-4.5",
-	"GLM-4.6",
-	"GLM-4.7",
-	"GLM-4.7-thinking",
-	"GLM-4.7-thinking-search",
-	"GLM-4.5-V",
-	"GLM-4.6-V",
-	"GLM-4.6-V-thinking",
-	"GLM-4.5-Air",
-	// "0808-360B-DR",
-}
-
 // 解析模型名称，提取基础模型名和标签
 // 支持 -thinking 和 -search 标签的任意排列组合
 func ParseModelName(model string) (baseModel string, enableThinking bool, enableSearch bool) {
@@ -56,21 +30,7 @@ func ParseModelName(model string) (baseModel string, enableThinking bool, enable
 }
 
 func IsThinkingModel(model string) bool {
-	_, enableThinking, _ := ParseModelName(model)
-	return enableThinking
-}
-
-func IsSearchModel(model string) bool {
-	_, _, enableSearch := ParseModelName(model)
-	return enableSearch
-}
-
-func GetTargetModel(model string) string {
-	baseModel, _, _ := ParseModelName(model)
-	if target, ok := BaseModelMapping[baseModel]; ok {
-		return target
-	}
-	return model
+	return GetModelRegistry().Resolve(model).Thinking
 }
 
 // OpenAI 格式的消息内容项
@@ -86,8 +46,11 @@ type ImageURL struct {
 
 // Message 支持纯文本和多模态内容
 type Message struct {
-	Role    string      `json:"role"`
-	Content interface{} `json:"content"` // string 或 []ContentPart
+	Role       string      `json:"role"`
+	Content    interface{} `json:"content"` // string 或 []ContentPart
+	Name       string      `json:"name,omitempty"`
+	ToolCalls  []ToolCall  `json:"tool_calls,omitempty"`
+	ToolCallID string      `json:"tool_call_id,omitempty"`
 }
 
 // 解析消息内容，返回文本和图片URL列表
@@ -154,9 +117,31 @@ func (m *Message) ToUpstreamMessage(urlToFileID map[string]string) map[string]in
 }
 
 type ChatRequest struct {
-	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
-	Stream   bool      `json:"stream"`
+	Model               string          `json:"model"`
+	Messages            []Message       `json:"messages"`
+	Stream              bool            `json:"stream"`
+	Tools               []Tool          `json:"tools,omitempty"`
+	ToolChoice          interface{}     `json:"tool_choice,omitempty"`
+	ResponseFormat      *ResponseFormat `json:"response_format,omitempty"`
+	StreamOptions       *StreamOptions  `json:"stream_options,omitempty"`
+	MaxTokens           int             `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int             `json:"max_completion_tokens,omitempty"` // 优先于 max_tokens
+	Stop                interface{}     `json:"stop,omitempty"`                  // string 或 []string
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type Usage struct {
+	PromptTokens            int                      `json:"prompt_tokens"`
+	CompletionTokens        int                      `json:"completion_tokens"`
+	TotalTokens             int                      `json:"total_tokens"`
+	CompletionTokensDetails *CompletionTokensDetails `json:"completion_tokens_details,omitempty"`
+}
+
+type CompletionTokensDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"`
 }
 
 type ChatCompletionChunk struct {
@@ -165,6 +150,7 @@ type ChatCompletionChunk struct {
 	Created int64    `json:"created"`
 	Model   string   `json:"model"`
 	Choices []Choice `json:"choices"`
+	Usage   *Usage   `json:"usage,omitempty"`
 }
 
 type Choice struct {
@@ -175,14 +161,17 @@ type Choice struct {
 }
 
 type Delta struct {
-	Content          string `json:"content,omitempty"`
-	ReasoningContent string `json:"reasoning_content,omitempty"`
+	Content          string     `json:"content,omitempty"`
+	ReasoningContent string     `json:"reasoning_content,omitempty"`
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
 }
 
 type MessageResp struct {
-	Role             string `json:"role"`
-	Content          string `json:"content"`
-	ReasoningContent string `json:"reasoning_content,omitempty"`
+	Role             string     `json:"role"`
+	Content          string     `json:"content"`
+	ReasoningContent string     `json:"reasoning_content,omitempty"`
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
+	Refusal          string     `json:"refusal,omitempty"`
 }
 
 type ChatCompletionResponse struct {
@@ -191,6 +180,7 @@ type ChatCompletionResponse struct {
 	Created int64    `json:"created"`
 	Model   string   `json:"model"`
 	Choices []Choice `json:"choices"`
+	Usage   *Usage   `json:"usage,omitempty"`
 }
 
 type ModelsResponse struct {
@@ -199,9 +189,10 @@ type ModelsResponse struct {
 }
 
 type ModelInfo struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	OwnedBy string `json:"owned_by"`
+	ID           string             `json:"id"`
+	Object       string             `json:"object"`
+	OwnedBy      string             `json:"owned_by"`
+	Capabilities *ModelCapabilities `json:"capabilities,omitempty"`
 }
 
 var searchRefPattern = regexp.MustCompile(`【turn\d+search(\d+)】`)
@@ -317,161 +308,12 @@ func (f *SearchRefFilter) GetSearchResultsMarkdown() string {
 	return sb.String()
 }
 
-func IsSearchResultContent(editContent string) bool {
-	return strings.Contains(editContent, `"search_result"`)
-}
-
-func ParseSearchResults(editContent string) []SearchResult {
-	searchResultKey := `"search_result":`
-	idx := strings.Index(editContent, searchResultKey)
-	if idx == -1 {
-		return nil
-	}
-
-	startIdx := idx + len(searchResultKey)
-	for startIdx < len(editContent) && editContent[startIdx] != '[' {
-		startIdx++
-	}
-	if startIdx >= len(editContent) {
-		return nil
-	}
-
-	bracketCount := 0
-	endIdx := startIdx
-	for endIdx < len(editContent) {
-		if editContent[endIdx] == '[' {
-			bracketCount++
-		} else if editContent[endIdx] == ']' {
-			bracketCount--
-			if bracketCount == 0 {
-				endIdx++
-				break
-			}
-		}
-		endIdx++
-	}
-
-	if bracketCount != 0 {
-		return nil
-	}
-
-	jsonStr := editContent[startIdx:endIdx]
-	var rawResults []struct {
-		Title string `json:"title"`
-		URL   string `json:"url"`
-		Index int    `json:"index"`
-		RefID string `json:"ref_id"`
-	}
-
-	if err := json.Unmarshal([]byte(jsonStr), &rawResults); err != nil {
-		return nil
-	}
-
-	var results []SearchResult
-	for _, r := range rawResults {
-		results = append(results, SearchResult{
-			Title: r.Title,
-			URL:   r.URL,
-			Index: r.Index,
-			RefID: r.RefID,
-		})
-	}
-
-	return results
-}
-
-func IsSearchToolCall(editContent string, phase string) bool {
-	if phase != "tool_call" {
-		return false
-	}
-	// tool_call 阶段包含 mcp 相关内容的都跳过
-	return strings.Contains(editContent, `"mcp"`) || strings.Contains(editContent, `mcp-server`)
-}
-
 type ImageSearchResult struct {
 	Title     string `json:"title"`
 	Link      string `json:"link"`
 	Thumbnail string `json:"thumbnail"`
 }
 
-func ParseImageSearchResults(editContent string) []ImageSearchResult {
-	resultKey := `"result":`
-	idx := strings.Index(editContent, resultKey)
-	if idx == -1 {
-		return nil
-	}
-
-	startIdx := idx + len(resultKey)
-	for startIdx < len(editContent) && editContent[startIdx] != '[' {
-		startIdx++
-	}
-	if startIdx >= len(editContent) {
-		return nil
-	}
-
-	bracketCount := 0
-	endIdx := startIdx
-	inString := false
-	escapeNext := false
-	for endIdx < len(editContent) {
-		ch := editContent[endIdx]
-
-		if escapeNext {
-			escapeNext = false
-			endIdx++
-			continue
-		}
-
-		if ch == '\\' {
-			escapeNext = true
-			endIdx++
-			continue
-		}
-
-		if ch == '"' {
-			inString = !inString
-		}
-
-		if !inString {
-			if ch == '[' || ch == '{' {
-				bracketCount++
-			} else if ch == ']' || ch == '}' {
-				bracketCount--
-				if bracketCount == 0 && ch == ']' {
-					endIdx++
-					break
-				}
-			}
-		}
-		endIdx++
-	}
-
-	if bracketCount != 0 {
-		return nil
-	}
-
-	jsonStr := editContent[startIdx:endIdx]
-
-	var rawResults []map[string]interface{}
-	if err := json.Unmarshal([]byte(jsonStr), &rawResults); err != nil {
-		return nil
-	}
-
-	var results []ImageSearchResult
-	for _, item := range rawResults {
-		if itemType, ok := item["type"].(string); ok && itemType == "text" {
-			if text, ok := item["text"].(string); ok {
-				result := parseImageSearchText(text)
-				if result.Title != "" && result.Link != "" {
-					results = append(results, result)
-				}
-			}
-		}
-	}
-
-	return results
-}
-
 func parseImageSearchText(text string) ImageSearchResult {
 	result := ImageSearchResult{}
 
@@ -515,14 +357,3 @@ func FormatImageSearchResults(results []ImageSearchResult) string {
 	sb.WriteString("\n")
 	return sb.String()
 }
-
-func ExtractTextBeforeGlmBlock(editContent string) string {
-	if idx := strings.Index(editContent, "<glm_block"); idx != -1 {
-		text := editContent[:idx]
-		if strings.HasSuffix(text, "\n") {
-			text = text[:len(text)-1]
-		}
-		return text
-	}
-	return ""
-}
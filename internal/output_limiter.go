@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"strings"
+)
+
+const (
+	limitReasonLength       = "length"
+	limitReasonStopSequence = "stop_sequence"
+)
+
+// OutputLimiter 按 max_tokens 预算截断输出，并跨 chunk 边界匹配停止序列
+// nil 表示不限制，所有方法都可以在 nil 上调用
+type OutputLimiter struct {
+	maxTokens int
+	used      TokenCounter
+	// 思考内容单独的 token 预算，如 Claude 的 thinking.budget_tokens，<= 0 表示不单独限制
+	reasoningBudget int
+	reasoningUsed   TokenCounter
+	stops           []string
+	holdBack        string
+	reason          string
+	stopSequence    string
+}
+
+func newOutputLimiter(maxTokens, reasoningBudget int, stops []string) *OutputLimiter {
+	var validStops []string
+	for _, s := range stops {
+		if s != "" {
+			validStops = append(validStops, s)
+		}
+	}
+	if maxTokens <= 0 && reasoningBudget <= 0 && len(validStops) == 0 {
+		return nil
+	}
+	return &OutputLimiter{maxTokens: maxTokens, reasoningBudget: reasoningBudget, stops: validStops}
+}
+
+// parseStopField 解析 OpenAI 的 stop 字段，支持字符串或字符串数组
+func parseStopField(stop interface{}) []string {
+	switch v := stop.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var stops []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				stops = append(stops, s)
+			}
+		}
+		return stops
+	}
+	return nil
+}
+
+func (l *OutputLimiter) Stopped() bool {
+	return l != nil && l.reason != ""
+}
+
+// Reason 返回 "length"、"stop_sequence" 或空字符串
+func (l *OutputLimiter) Reason() string {
+	if l == nil {
+		return ""
+	}
+	return l.reason
+}
+
+func (l *OutputLimiter) StopSequence() string {
+	if l == nil {
+		return ""
+	}
+	return l.stopSequence
+}
+
+// Reasoning 处理思考内容，只消耗 token 预算，不匹配停止序列。
+// 超出思考预算的部分被丢弃，但不结束输出，正文仍然照常返回
+func (l *OutputLimiter) Reasoning(text string) string {
+	if l == nil || text == "" {
+		return text
+	}
+	if l.Stopped() {
+		return ""
+	}
+	if l.reasoningBudget > 0 {
+		remaining := float64(l.reasoningBudget) - l.reasoningUsed.total
+		if weight := estimateTokenWeight(text); weight > remaining {
+			text = prefixWithin(text, remaining)
+			l.reasoningUsed.total = float64(l.reasoningBudget)
+		} else {
+			l.reasoningUsed.total += weight
+		}
+	}
+	return l.consume(text)
+}
+
+// Content 处理正文，末尾可能是停止序列前缀的部分会暂存到下一次
+func (l *OutputLimiter) Content(text string) string {
+	if l == nil || text == "" {
+		return text
+	}
+	if l.Stopped() {
+		return ""
+	}
+	if len(l.stops) == 0 {
+		return l.consume(text)
+	}
+
+	text = l.holdBack + text
+	l.holdBack = ""
+
+	if idx, stop := l.findStop(text); idx != -1 {
+		out := l.consume(text[:idx])
+		if !l.Stopped() {
+			l.reason = limitReasonStopSequence
+			l.stopSequence = stop
+		}
+		return out
+	}
+
+	keep := 0
+	for _, stop := range l.stops {
+		if n := partialSuffixLen(text, stop); n > keep {
+			keep = n
+		}
+	}
+	l.holdBack = text[len(text)-keep:]
+	return l.consume(text[:len(text)-keep])
+}
+
+// Flush 输出暂存的停止序列前缀
+func (l *OutputLimiter) Flush() string {
+	if l == nil || l.holdBack == "" {
+		return ""
+	}
+	text := l.holdBack
+	l.holdBack = ""
+	if l.Stopped() {
+		return ""
+	}
+	return l.consume(text)
+}
+
+func (l *OutputLimiter) findStop(text string) (int, string) {
+	bestIdx := -1
+	bestStop := ""
+	for _, stop := range l.stops {
+		if idx := strings.Index(text, stop); idx != -1 && (bestIdx == -1 || idx < bestIdx) {
+			bestIdx = idx
+			bestStop = stop
+		}
+	}
+	return bestIdx, bestStop
+}
+
+// consume 扣除 token 预算，超出时截断到预算内的最长前缀
+func (l *OutputLimiter) consume(text string) string {
+	if l.maxTokens <= 0 || text == "" {
+		return text
+	}
+
+	remaining := float64(l.maxTokens) - l.used.total
+	weight := estimateTokenWeight(text)
+	if weight <= remaining {
+		l.used.total += weight
+		return text
+	}
+
+	out := prefixWithin(text, remaining)
+	l.used.total = float64(l.maxTokens)
+	l.reason = limitReasonLength
+	return out
+}
+
+// prefixWithin 二分查找 token 数不超过 budget 的最长前缀
+func prefixWithin(text string, budget float64) string {
+	runes := []rune(text)
+	lo, hi := 0, len(runes)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if estimateTokenWeight(string(runes[:mid])) <= budget {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return string(runes[:lo])
+}
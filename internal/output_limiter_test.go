@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOutputLimiterStopSequences(t *testing.T) {
+	tests := []struct {
+		name       string
+		stops      []string
+		chunks     []string
+		want       string
+		wantReason string
+		wantStop   string
+	}{
+		{"no stop sequence", []string{"END"}, []string{"hello ", "world"}, "hello world", "", ""},
+		{"stop inside one chunk", []string{"END"}, []string{"abcENDdef"}, "abc", limitReasonStopSequence, "END"},
+		{"stop split across chunks", []string{"END"}, []string{"abcE", "N", "Ddef"}, "abc", limitReasonStopSequence, "END"},
+		{"prefix that does not complete", []string{"END"}, []string{"abcE", "Nx"}, "abcENx", "", ""},
+		{"prefix held until flush", []string{"END"}, []string{"abcEN"}, "abcEN", "", ""},
+		{"earliest of several stops", []string{"world", "lo w"}, []string{"hel", "lo world"}, "hel", limitReasonStopSequence, "lo w"},
+		{"output after stop is dropped", []string{"\n\n"}, []string{"a\n", "\nb", "c"}, "a", limitReasonStopSequence, "\n\n"},
+		{"multibyte stop split across chunks", []string{"。结束"}, []string{"你好。", "结", "束了"}, "你好", limitReasonStopSequence, "。结束"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newOutputLimiter(0, 0, tt.stops)
+			var out strings.Builder
+			for _, chunk := range tt.chunks {
+				out.WriteString(limiter.Content(chunk))
+			}
+			out.WriteString(limiter.Flush())
+			if got := out.String(); got != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+			if limiter.Reason() != tt.wantReason || limiter.StopSequence() != tt.wantStop {
+				t.Errorf("reason = %q, stop = %q, want %q, %q", limiter.Reason(), limiter.StopSequence(), tt.wantReason, tt.wantStop)
+			}
+		})
+	}
+}
+
+func TestOutputLimiterMaxTokens(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxTokens  int
+		reasoning  []string
+		chunks     []string
+		want       string
+		wantReason string
+	}{
+		{"within budget", 10, nil, []string{"一二", "三四"}, "一二三四", ""},
+		{"truncated at budget", 5, nil, []string{"一二三四五", "六七八九十"}, "一二三四五六七八", limitReasonLength},
+		{"reasoning consumes budget", 5, []string{"一二三四五"}, []string{"六七八九十"}, "六七八", limitReasonLength},
+		{"nothing after limit", 1, nil, []string{"一二三四", "五"}, "一", limitReasonLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newOutputLimiter(tt.maxTokens, 0, nil)
+			for _, text := range tt.reasoning {
+				limiter.Reasoning(text)
+			}
+			var out strings.Builder
+			for _, chunk := range tt.chunks {
+				out.WriteString(limiter.Content(chunk))
+			}
+			out.WriteString(limiter.Flush())
+			if got := out.String(); got != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+			if limiter.Reason() != tt.wantReason {
+				t.Errorf("reason = %q, want %q", limiter.Reason(), tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestOutputLimiterNil(t *testing.T) {
+	limiter := newOutputLimiter(0, 0, []string{""})
+	if limiter != nil {
+		t.Fatalf("expected nil limiter without limits")
+	}
+	if got := limiter.Content("abc") + limiter.Reasoning("x") + limiter.Flush(); got != "abcx" {
+		t.Fatalf("output = %q", got)
+	}
+	if limiter.Stopped() || limiter.Reason() != "" {
+		t.Fatalf("nil limiter reports a stop")
+	}
+}
+
+func TestOutputLimiterReasoningBudget(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxTokens     int
+		budget        int
+		reasoning     []string
+		content       string
+		wantReasoning string
+		wantContent   string
+		wantReason    string
+	}{
+		{"within budget", 0, 10, []string{"一二", "三四"}, "正文", "一二三四", "正文", ""},
+		{"reasoning truncated, content kept", 0, 3, []string{"一二三四五", "六七"}, "正文", "一二三四", "正文", ""},
+		{"reasoning also counts toward max_tokens", 5, 3, []string{"一二三四五"}, "六七八九十", "一二三四", "六七八九", limitReasonLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newOutputLimiter(tt.maxTokens, tt.budget, nil)
+			var reasoning strings.Builder
+			for _, text := range tt.reasoning {
+				reasoning.WriteString(limiter.Reasoning(text))
+			}
+			content := limiter.Content(tt.content) + limiter.Flush()
+			if reasoning.String() != tt.wantReasoning {
+				t.Errorf("reasoning = %q, want %q", reasoning.String(), tt.wantReasoning)
+			}
+			if content != tt.wantContent {
+				t.Errorf("content = %q, want %q", content, tt.wantContent)
+			}
+			if limiter.Reason() != tt.wantReason {
+				t.Errorf("reason = %q, want %q", limiter.Reason(), tt.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,453 @@
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PoolStrategyRoundRobin = "round_robin"
+	PoolStrategyLeastBusy  = "least_busy"
+
+	maxPoolCooldown = 10 * time.Minute
+)
+
+// PooledToken 是账号池中的一个 z.ai 账号及其健康状态
+type PooledToken struct {
+	Name  string
+	Token string
+	// 该账号专用的出口代理，为空时使用 UPSTREAM_PROXY
+	Proxy string
+
+	inFlight            int
+	successCount        int
+	unauthorizedCount   int
+	rateLimitedCount    int
+	serverErrorCount    int
+	networkErrorCount   int
+	consecutiveFailures int
+	cooldownUntil       time.Time
+	evicted             bool
+	lastUsed            time.Time
+	lastError           string
+}
+
+type TokenPool struct {
+	mu          sync.Mutex
+	tokens      []*PooledToken
+	next        int
+	strategy    string
+	cooldown    time.Duration
+	maxFailures int
+}
+
+// TokenPoolEntry 是 TOKEN_POOL_FILE 中的一项
+type TokenPoolEntry struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Proxy string `json:"proxy,omitempty"`
+}
+
+// TokenStatus 是管理接口返回的账号状态
+type TokenStatus struct {
+	Name                string     `json:"name"`
+	Token               string     `json:"token"`
+	State               string     `json:"state"`
+	InFlight            int        `json:"in_flight"`
+	SuccessCount        int        `json:"success_count"`
+	UnauthorizedCount   int        `json:"unauthorized_count"`
+	RateLimitedCount    int        `json:"rate_limited_count"`
+	ServerErrorCount    int        `json:"server_error_count"`
+	NetworkErrorCount   int        `json:"network_error_count"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	CooldownUntil       *time.Time `json:"cooldown_until,omitempty"`
+	LastUsed            *time.Time `json:"last_used,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+var Pool *TokenPool
+
+func NewTokenPool(entries []TokenPoolEntry, strategy string, cooldown time.Duration, maxFailures int) *TokenPool {
+	pool := &TokenPool{
+		strategy:    strategy,
+		cooldown:    cooldown,
+		maxFailures: maxFailures,
+	}
+	for i, e := range entries {
+		name := e.Name
+		if name == "" {
+			name = fmt.Sprintf("token-%d", i+1)
+		}
+		pool.tokens = append(pool.tokens, &PooledToken{Name: name, Token: e.Token, Proxy: e.Proxy})
+	}
+	return pool
+}
+
+// InitTokenPool 从 ZAI_TOKENS 和 TOKEN_POOL_FILE 加载账号池
+func InitTokenPool() {
+	var entries []TokenPoolEntry
+	for _, t := range Cfg.PoolTokens {
+		entries = append(entries, TokenPoolEntry{Token: t})
+	}
+
+	if Cfg.PoolFile != "" {
+		data, err := os.ReadFile(Cfg.PoolFile)
+		if err != nil {
+			LogError("Failed to read token pool file: %v", err)
+		} else {
+			var fileEntries []TokenPoolEntry
+			if err := json.Unmarshal(data, &fileEntries); err != nil {
+				LogError("Failed to parse token pool file: %v", err)
+			} else {
+				entries = append(entries, fileEntries...)
+			}
+		}
+	}
+
+	if len(entries) == 0 {
+		return
+	}
+
+	Pool = NewTokenPool(entries, Cfg.PoolStrategy, Cfg.PoolCooldown, Cfg.PoolMaxFailures)
+	LogInfo("Token pool loaded: %d tokens, strategy=%s", len(entries), Cfg.PoolStrategy)
+}
+
+func (t *PooledToken) available(now time.Time) bool {
+	return !t.evicted && !now.Before(t.cooldownUntil)
+}
+
+// Acquire 选择一个可用账号并增加其并发计数，使用完毕后必须调用 Release
+func (p *TokenPool) Acquire() (*PooledToken, error) {
+	return p.AcquireExcluding(nil)
+}
+
+// AcquireExcluding 与 Acquire 相同，但跳过 exclude 中的账号，用于重试时换号
+func (p *TokenPool) AcquireExcluding(exclude map[*PooledToken]bool) (*PooledToken, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var selected *PooledToken
+	switch p.strategy {
+	case PoolStrategyLeastBusy:
+		for _, t := range p.tokens {
+			if !t.available(now) || exclude[t] {
+				continue
+			}
+			if selected == nil || t.inFlight < selected.inFlight ||
+				(t.inFlight == selected.inFlight && t.lastUsed.Before(selected.lastUsed)) {
+				selected = t
+			}
+		}
+	default:
+		for i := 0; i < len(p.tokens); i++ {
+			t := p.tokens[(p.next+i)%len(p.tokens)]
+			if t.available(now) && !exclude[t] {
+				selected = t
+				p.next = (p.next + i + 1) % len(p.tokens)
+				break
+			}
+		}
+	}
+
+	if selected == nil {
+		return nil, errPoolExhausted
+	}
+	selected.inFlight++
+	selected.lastUsed = now
+	return selected, nil
+}
+
+// Release 减少账号的并发计数
+func (p *TokenPool) Release(t *PooledToken) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t.inFlight > 0 {
+		t.inFlight--
+	}
+}
+
+// Report 根据上游响应更新账号健康状态
+// statusCode 为 0 表示网络错误
+func (p *TokenPool) Report(t *PooledToken, statusCode int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch {
+	case err != nil || statusCode == 0:
+		t.networkErrorCount++
+		t.lastError = fmt.Sprintf("network error: %v", err)
+	case statusCode == http.StatusOK:
+		t.successCount++
+		t.consecutiveFailures = 0
+		return
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		t.unauthorizedCount++
+		t.lastError = fmt.Sprintf("status %d", statusCode)
+	case statusCode == http.StatusTooManyRequests:
+		t.rateLimitedCount++
+		t.lastError = fmt.Sprintf("status %d", statusCode)
+	case statusCode >= 500:
+		t.serverErrorCount++
+		t.lastError = fmt.Sprintf("status %d", statusCode)
+	default:
+		// 其他 4xx 通常是请求本身的问题，不影响账号健康
+		return
+	}
+
+	t.consecutiveFailures++
+
+	// 连续认证失败的账号视为失效，直接移出轮询
+	if (statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden) && t.consecutiveFailures >= p.maxFailures {
+		t.evicted = true
+		LogWarn("[Pool] Token %s evicted after %d consecutive auth failures", t.Name, t.consecutiveFailures)
+		return
+	}
+
+	// 冷却时间随连续失败次数指数增长
+	cooldown := p.cooldown << uint(min(t.consecutiveFailures-1, 10))
+	if cooldown > maxPoolCooldown {
+		cooldown = maxPoolCooldown
+	}
+	t.cooldownUntil = time.Now().Add(cooldown)
+	LogWarn("[Pool] Token %s cooling down for %s (%s)", t.Name, cooldown, t.lastError)
+}
+
+// Status 返回所有账号的当前状态
+func (p *TokenPool) Status() []TokenStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var result []TokenStatus
+	for _, t := range p.tokens {
+		status := TokenStatus{
+			Name:                t.Name,
+			Token:               maskToken(t.Token),
+			State:               "active",
+			InFlight:            t.inFlight,
+			SuccessCount:        t.successCount,
+			UnauthorizedCount:   t.unauthorizedCount,
+			RateLimitedCount:    t.rateLimitedCount,
+			ServerErrorCount:    t.serverErrorCount,
+			NetworkErrorCount:   t.networkErrorCount,
+			ConsecutiveFailures: t.consecutiveFailures,
+			LastError:           t.lastError,
+		}
+		if t.evicted {
+			status.State = "evicted"
+		} else if now.Before(t.cooldownUntil) {
+			status.State = "cooldown"
+			cooldownUntil := t.cooldownUntil
+			status.CooldownUntil = &cooldownUntil
+		}
+		if !t.lastUsed.IsZero() {
+			lastUsed := t.lastUsed
+			status.LastUsed = &lastUsed
+		}
+		result = append(result, status)
+	}
+	return result
+}
+
+// 日志和管理接口中只展示 token 的首尾
+func maskToken(token string) string {
+	if len(token) <= 16 {
+		return "***"
+	}
+	return token[:8] + "..." + token[len(token)-4:]
+}
+
+// HandleAdminTokens 列出账号池中所有账号的状态
+func HandleAdminTokens(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(w, r) {
+		return
+	}
+
+	tokens := []TokenStatus{}
+	if Pool != nil {
+		tokens = Pool.Status()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"object": "list",
+		"data":   tokens,
+	})
+}
+
+// checkAdminAuth 校验 ADMIN_KEY，未配置时管理接口不可用
+func checkAdminAuth(w http.ResponseWriter, r *http.Request) bool {
+	if Cfg.AdminKey == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	key := r.Header.Get("x-api-key")
+	if key == "" {
+		key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(Cfg.AdminKey)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// tokenLease 是一次请求使用的上游 token
+type tokenLease struct {
+	Token     string
+	Proxy     string
+	pooled    *PooledToken
+	anonymous bool
+	// 代理签发的 key，用于限流和用量统计
+	apiKey *APIKey
+	stream bool
+}
+
+// Report 将上游响应结果反馈给账号池，匿名 token 被拒绝时移出缓存
+func (l *tokenLease) Report(statusCode int, err error) {
+	if l.pooled != nil {
+		Pool.Report(l.pooled, statusCode, err)
+	}
+	if l.anonymous && (statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden) {
+		AnonTokens.Invalidate(l.Token)
+	}
+}
+
+// Release 归还账号池中的账号和 key 的并发流名额
+func (l *tokenLease) Release() {
+	if l.pooled != nil {
+		Pool.Release(l.pooled)
+	}
+	if l.stream {
+		APIKeys.releaseStream(l.apiKey)
+	}
+}
+
+// failover 换用另一个上游 token：账号池跳过已尝试过的账号，匿名 token 重新获取。
+// 没有可换的 token 时保留当前 token 并返回 false
+func (l *tokenLease) failover(ctx context.Context, tried map[*PooledToken]bool) bool {
+	switch {
+	case l.pooled != nil:
+		next, err := Pool.AcquireExcluding(tried)
+		if err != nil {
+			return false
+		}
+		Pool.Release(l.pooled)
+		LogInfo("[Pool] Failing over from token %s to %s", l.pooled.Name, next.Name)
+		l.pooled, l.Token, l.Proxy = next, next.Token, next.Proxy
+		return true
+	case l.anonymous:
+		token, err := AnonTokens.Get(ctx)
+		if err != nil || token == l.Token {
+			return false
+		}
+		l.Token = token
+		return true
+	}
+	return false
+}
+
+// CheckLimits 检查 key 的限额并写入 x-ratelimit-* 响应头，超限时返回 *rateLimitError
+func (l *tokenLease) CheckLimits(w http.ResponseWriter, stream bool) error {
+	if l.apiKey == nil {
+		return nil
+	}
+	status, err := APIKeys.acquire(l.apiKey, stream)
+	writeRateLimitHeaders(w, status, err)
+	if err == nil && stream && status != nil {
+		l.stream = true
+	}
+	return err
+}
+
+// RecordUsage 累加 key 的 token 用量
+func (l *tokenLease) RecordUsage(tokens int) {
+	if l.apiKey != nil {
+		APIKeys.AddUsage(l.apiKey, tokens)
+	}
+}
+
+var errPoolExhausted = fmt.Errorf("no available token in pool")
+
+// proxyAPIKeyEnabled 判断客户端能否使用 PROXY_API_KEY 直接调用账号池
+func proxyAPIKeyEnabled() bool {
+	return Cfg.ProxyAPIKey != "" && Cfg.AllowProxyAPIKey
+}
+
+// resolveToken 将客户端提供的 key 解析为上游 z.ai token
+// 依次匹配 "free"（及按配置视为 free 的 sk-ant- key）、PROXY_API_KEY、代理签发的 key，
+// 允许透传时其余 key 视为 z.ai token 直接使用，否则返回 authError
+func resolveToken(ctx context.Context, apiKey string) (*tokenLease, error) {
+	if Cfg.AnthropicKeyFree && strings.HasPrefix(apiKey, "sk-ant-") {
+		LogDebug("Treating Anthropic API key as 'free'")
+		apiKey = "free"
+	}
+
+	if apiKey == "free" {
+		if !Cfg.AllowAnonymous {
+			return nil, authError("Anonymous access is disabled")
+		}
+		return anonymousLease(ctx)
+	}
+
+	if Pool != nil && proxyAPIKeyEnabled() && subtle.ConstantTimeCompare([]byte(apiKey), []byte(Cfg.ProxyAPIKey)) == 1 {
+		return poolLease()
+	}
+
+	if APIKeys != nil {
+		key, err := APIKeys.Lookup(apiKey)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			LogDebug("[Keys] Using API key %s (%s)", key.ID, key.Name)
+			var lease *tokenLease
+			switch key.Target {
+			case APIKeyTargetPool:
+				if Pool == nil {
+					return nil, fmt.Errorf("token pool is not configured")
+				}
+				lease, err = poolLease()
+			case APIKeyTargetAnonymous:
+				lease, err = anonymousLease(ctx)
+			default:
+				lease = &tokenLease{Token: key.Token}
+			}
+			if err != nil {
+				return nil, err
+			}
+			lease.apiKey = key
+			return lease, nil
+		}
+	}
+
+	if !Cfg.AllowRawTokens {
+		return nil, authError("Invalid API key")
+	}
+	return &tokenLease{Token: apiKey}, nil
+}
+
+func anonymousLease(ctx context.Context) (*tokenLease, error) {
+	anonymousToken, err := AnonTokens.Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get anonymous token: %v", err)
+	}
+	return &tokenLease{Token: anonymousToken, anonymous: true}, nil
+}
+
+func poolLease() (*tokenLease, error) {
+	pooled, err := Pool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	LogDebug("[Pool] Using token %s", pooled.Name)
+	return &tokenLease{Token: pooled.Token, Proxy: pooled.Proxy, pooled: pooled}, nil
+}
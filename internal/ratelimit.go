@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// KeyLimits 是单个 API key 的限额，0 表示不限制
+type KeyLimits struct {
+	RequestsPerMinute int `json:"requests_per_minute,omitempty"`
+	ConcurrentStreams int `json:"concurrent_streams,omitempty"`
+	DailyTokens       int `json:"daily_tokens,omitempty"`
+}
+
+// KeyUsage 记录 key 当天（UTC）已用的估算 token 数，随 key 文件持久化
+type KeyUsage struct {
+	Date   string `json:"date,omitempty"`
+	Tokens int    `json:"tokens,omitempty"`
+}
+
+// rateLimitError 表示请求超出 key 的限额
+type rateLimitError struct {
+	message    string
+	kind       string // "requests" / "tokens"，对应 OpenAI 错误的 type
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return e.message
+}
+
+// rateLimitStatus 是写入 x-ratelimit-* 响应头的当前额度
+type rateLimitStatus struct {
+	limitRequests     int
+	remainingRequests int
+	resetRequests     time.Duration
+	limitTokens       int
+	remainingTokens   int
+	resetTokens       time.Duration
+}
+
+func usageDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+func untilNextUTCDay(now time.Time) time.Duration {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC).Sub(now)
+}
+
+// todayTokens 返回 key 当天已用 token 数，调用方需持有锁
+func (k *APIKey) todayTokens(now time.Time) int {
+	if k.Usage.Date != usageDate(now) {
+		return 0
+	}
+	return k.Usage.Tokens
+}
+
+// acquire 检查 key 的限额，通过时记录本次请求，流式请求占用一个并发名额
+func (s *APIKeyStore) acquire(k *APIKey, stream bool) (*rateLimitStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if k.Limits == nil {
+		return nil, nil
+	}
+	limits := *k.Limits
+	now := time.Now()
+	status := &rateLimitStatus{}
+
+	// 每分钟请求数使用滑动窗口
+	var window []time.Time
+	if limits.RequestsPerMinute > 0 {
+		for _, t := range s.requests[k.ID] {
+			if now.Sub(t) < time.Minute {
+				window = append(window, t)
+			}
+		}
+		s.requests[k.ID] = window
+		status.limitRequests = limits.RequestsPerMinute
+		status.remainingRequests = max(limits.RequestsPerMinute-len(window), 0)
+		if len(window) > 0 {
+			status.resetRequests = window[0].Add(time.Minute).Sub(now)
+		}
+		if len(window) >= limits.RequestsPerMinute {
+			return status, &rateLimitError{
+				message:    fmt.Sprintf("Rate limit reached: %d requests per minute", limits.RequestsPerMinute),
+				kind:       "requests",
+				retryAfter: status.resetRequests,
+			}
+		}
+	}
+
+	if limits.DailyTokens > 0 {
+		used := k.todayTokens(now)
+		status.limitTokens = limits.DailyTokens
+		status.remainingTokens = max(limits.DailyTokens-used, 0)
+		status.resetTokens = untilNextUTCDay(now)
+		if used >= limits.DailyTokens {
+			return status, &rateLimitError{
+				message:    fmt.Sprintf("Daily token quota exceeded: %d tokens", limits.DailyTokens),
+				kind:       "tokens",
+				retryAfter: status.resetTokens,
+			}
+		}
+	}
+
+	if stream && limits.ConcurrentStreams > 0 && s.streams[k.ID] >= limits.ConcurrentStreams {
+		return status, &rateLimitError{
+			message:    fmt.Sprintf("Too many concurrent streams: limit is %d", limits.ConcurrentStreams),
+			kind:       "requests",
+			retryAfter: time.Second,
+		}
+	}
+
+	if limits.RequestsPerMinute > 0 {
+		s.requests[k.ID] = append(window, now)
+		status.remainingRequests--
+		if status.resetRequests == 0 {
+			status.resetRequests = time.Minute
+		}
+	}
+	if stream {
+		s.streams[k.ID]++
+	}
+	return status, nil
+}
+
+func (s *APIKeyStore) releaseStream(k *APIKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.streams[k.ID] > 0 {
+		s.streams[k.ID]--
+	}
+}
+
+// AddUsage 累加 key 当天的 token 用量，由后台定期写入文件；
+// 用量刚达到每日额度时立即写入，避免重启后超额的 key 恢复可用
+func (s *APIKeyStore) AddUsage(k *APIKey, tokens int) {
+	if tokens <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	today := usageDate(time.Now())
+	if k.Usage.Date != today {
+		k.Usage = KeyUsage{Date: today}
+	}
+	before := k.Usage.Tokens
+	k.Usage.Tokens += tokens
+	s.dirty = true
+	if k.Limits != nil && k.Limits.DailyTokens > 0 && before < k.Limits.DailyTokens && k.Usage.Tokens >= k.Limits.DailyTokens {
+		if err := s.save(); err != nil {
+			LogError("Failed to save API key usage: %v", err)
+		}
+	}
+}
+
+// SetLimits 更新 key 的限额，limits 为 nil 时取消限制
+func (s *APIKeyStore) SetLimits(id string, limits *KeyLimits) (*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.keys {
+		if k.ID != id {
+			continue
+		}
+		old := k.Limits
+		k.Limits = limits
+		if err := s.save(); err != nil {
+			k.Limits = old
+			return nil, err
+		}
+		return k, nil
+	}
+	return nil, nil
+}
+
+// startUsageFlusher 定期将有变化的用量写入文件，保证重启后额度不被重置
+func (s *APIKeyStore) startUsageFlusher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			s.FlushUsage()
+		}
+	}()
+}
+
+// FlushUsage 立即写入尚未保存的用量
+func (s *APIKeyStore) FlushUsage() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return
+	}
+	if err := s.save(); err != nil {
+		LogError("Failed to save API key usage: %v", err)
+	}
+}
+
+// FlushAPIKeyUsage 在退出前写入尚未保存的用量，未启用签发 key 时不做任何事
+func FlushAPIKeyUsage() {
+	if APIKeys != nil {
+		APIKeys.FlushUsage()
+	}
+}
+
+// writeRateLimitHeaders 写入 x-ratelimit-* 响应头，超限时附带 Retry-After
+func writeRateLimitHeaders(w http.ResponseWriter, status *rateLimitStatus, err error) {
+	if status != nil {
+		h := w.Header()
+		if status.limitRequests > 0 {
+			h.Set("x-ratelimit-limit-requests", strconv.Itoa(status.limitRequests))
+			h.Set("x-ratelimit-remaining-requests", strconv.Itoa(status.remainingRequests))
+			h.Set("x-ratelimit-reset-requests", formatResetDuration(status.resetRequests))
+		}
+		if status.limitTokens > 0 {
+			h.Set("x-ratelimit-limit-tokens", strconv.Itoa(status.limitTokens))
+			h.Set("x-ratelimit-remaining-tokens", strconv.Itoa(status.remainingTokens))
+			h.Set("x-ratelimit-reset-tokens", formatResetDuration(status.resetTokens))
+		}
+	}
+	if rlErr, ok := err.(*rateLimitError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rlErr.retryAfter.Seconds()))))
+	}
+}
+
+// OpenAI 风格的重置时间，如 "1s"、"6m0s"
+func formatResetDuration(d time.Duration) string {
+	if d < time.Second {
+		d = time.Second
+	}
+	return d.Round(time.Second).String()
+}
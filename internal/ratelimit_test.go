@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestAddUsagePersistsWhenQuotaReached(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	store, err := LoadAPIKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &APIKey{ID: "k1", Limits: &KeyLimits{DailyTokens: 10}}
+	store.keys = append(store.keys, key)
+
+	// savedUsage 返回文件中记录的用量，文件不存在时为 0
+	savedUsage := func() int {
+		loaded, err := LoadAPIKeyStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(loaded.keys) == 0 {
+			return 0
+		}
+		return loaded.keys[0].Usage.Tokens
+	}
+
+	store.AddUsage(key, 4)
+	if got := savedUsage(); got != 0 {
+		t.Fatalf("usage below quota written immediately: %d", got)
+	}
+	store.AddUsage(key, 7)
+	if got := savedUsage(); got != 11 {
+		t.Fatalf("saved usage after reaching quota = %d, want 11", got)
+	}
+	store.AddUsage(key, 2)
+	if got := savedUsage(); got != 11 {
+		t.Fatalf("usage above quota written before flush: %d", got)
+	}
+	store.FlushUsage()
+	if got := savedUsage(); got != 13 {
+		t.Fatalf("saved usage after FlushUsage = %d, want 13", got)
+	}
+}
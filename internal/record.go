@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RecordingMeta 是录制文件旁的 .meta.json，记录回放时需要的请求参数
+type RecordingMeta struct {
+	Model       string    `json:"model"`
+	TargetModel string    `json:"target_model"`
+	Thinking    bool      `json:"thinking"`
+	Tools       bool      `json:"tools,omitempty"`
+	RecordedAt  time.Time `json:"recorded_at"`
+}
+
+// recordingBody 在读取上游响应的同时写入录制文件
+type recordingBody struct {
+	io.Reader
+	body io.ReadCloser
+	file *os.File
+}
+
+func (r *recordingBody) Close() error {
+	r.file.Close()
+	return r.body.Close()
+}
+
+// recordUpstream 在设置了 RECORD_DIR 时将上游原始 SSE 保存为 <dir>/<时间>-<completionID>.sse
+func recordUpstream(body io.ReadCloser, completionID string, meta RecordingMeta) io.ReadCloser {
+	if Cfg.RecordDir == "" {
+		return body
+	}
+	if err := os.MkdirAll(Cfg.RecordDir, 0755); err != nil {
+		LogError("[Record] Failed to create record dir: %v", err)
+		return body
+	}
+
+	meta.RecordedAt = time.Now().UTC()
+	base := filepath.Join(Cfg.RecordDir, meta.RecordedAt.Format("20060102-150405")+"-"+completionID)
+	file, err := os.Create(base + ".sse")
+	if err != nil {
+		LogError("[Record] Failed to create recording: %v", err)
+		return body
+	}
+	metaData, _ := json.MarshalIndent(meta, "", "  ")
+	if err := os.WriteFile(base+".meta.json", metaData, 0644); err != nil {
+		LogError("[Record] Failed to write recording meta: %v", err)
+	}
+	LogDebug("[Record] Recording upstream stream to %s.sse", base)
+
+	return &recordingBody{
+		Reader: io.TeeReader(body, file),
+		body:   body,
+		file:   file,
+	}
+}
@@ -0,0 +1,312 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+)
+
+// ModelCapabilities 描述模型支持的功能，thinking / search 为 false 时忽略对应标签
+type ModelCapabilities struct {
+	Vision   bool `json:"vision"`
+	Thinking bool `json:"thinking"`
+	Search   bool `json:"search"`
+	Tools    bool `json:"tools"`
+}
+
+// ModelDefinition 是模型注册表中的一个模型
+type ModelDefinition struct {
+	ID           string            `json:"id"`
+	Upstream     string            `json:"upstream"`
+	Capabilities ModelCapabilities `json:"capabilities"`
+	// 默认启用的 MCP 服务
+	MCPServers []string `json:"mcp_servers,omitempty"`
+	// 覆盖上游请求 features 中的字段
+	Features map[string]interface{} `json:"features,omitempty"`
+	// 在 /v1/models 中额外列出的标签组合，如 "thinking"、"thinking-search"
+	Variants []string `json:"variants,omitempty"`
+	// 不在 /v1/models 中列出，但仍可调用
+	Hidden bool `json:"hidden,omitempty"`
+	// 由模型发现自动添加，不来自注册表文件
+	Discovered bool `json:"discovered,omitempty"`
+}
+
+// ModelRegistry 是模型名、别名到上游模型的映射
+type ModelRegistry struct {
+	Models  []ModelDefinition `json:"models"`
+	Aliases map[string]string `json:"aliases,omitempty"`
+
+	byID map[string]*ModelDefinition
+}
+
+// ResolvedModel 是解析别名和标签后的模型
+type ResolvedModel struct {
+	// 未注册的模型为 nil，此时按原名透传给上游
+	Definition *ModelDefinition
+	Upstream   string
+	Thinking   bool
+	Search     bool
+}
+
+var (
+	// baseModelRegistry 来自内置模型或 MODELS_FILE，modelRegistry 在其基础上合并发现的模型
+	baseModelRegistry = defaultModelRegistry()
+	modelRegistry     = baseModelRegistry
+	discoveredModels  []ModelDefinition
+	modelRegistryLock sync.RWMutex
+	modelsFile        *fileWatcher
+)
+
+// defaultModelRegistry 是未配置 MODELS_FILE 时使用的内置模型
+func defaultModelRegistry() *ModelRegistry {
+	text := ModelCapabilities{Thinking: true, Search: true, Tools: true}
+	vision := ModelCapabilities{Vision: true, Thinking: true, Tools: true}
+	registry := &ModelRegistry{
+		Models: []ModelDefinition{
+			{ID: "GLM-4.5", Upstream: "0727-360B-API", Capabilities: text},
+			{ID: "GLM-4.6", Upstream: "GLM-4-6-API-V1", Capabilities: text},
+			{ID: "GLM-4.7", Upstream: "glm-4.7", Capabilities: text, Variants: []string{"thinking", "thinking-search"}},
+			{ID: "GLM-4.5-V", Upstream: "glm-4.5v", Capabilities: vision},
+			{
+				ID: "GLM-4.6-V", Upstream: "glm-4.6v", Capabilities: vision,
+				MCPServers: []string{"vlm-image-search", "vlm-image-recognition", "vlm-image-processing"},
+				Variants:   []string{"thinking"},
+			},
+			{ID: "GLM-4.5-Air", Upstream: "0727-106B-API", Capabilities: text},
+			{ID: "0808-360B-DR", Upstream: "0808-360B-DR", Capabilities: text, Hidden: true},
+		},
+	}
+	registry.index()
+	return registry
+}
+
+// GetModelRegistry 返回当前生效的模型注册表
+func GetModelRegistry() *ModelRegistry {
+	modelRegistryLock.RLock()
+	defer modelRegistryLock.RUnlock()
+	return modelRegistry
+}
+
+func getBaseModelRegistry() *ModelRegistry {
+	modelRegistryLock.RLock()
+	defer modelRegistryLock.RUnlock()
+	return baseModelRegistry
+}
+
+func setModelRegistry(registry *ModelRegistry) {
+	modelRegistryLock.Lock()
+	baseModelRegistry = registry
+	modelRegistry = registry.withDiscovered(discoveredModels)
+	modelRegistryLock.Unlock()
+}
+
+func setDiscoveredModels(models []ModelDefinition) {
+	modelRegistryLock.Lock()
+	discoveredModels = models
+	modelRegistry = baseModelRegistry.withDiscovered(models)
+	modelRegistryLock.Unlock()
+}
+
+// withDiscovered 返回追加了发现模型的注册表副本，已注册的模型名和上游 ID 不会被覆盖
+func (r *ModelRegistry) withDiscovered(models []ModelDefinition) *ModelRegistry {
+	if len(models) == 0 {
+		return r
+	}
+	merged := &ModelRegistry{
+		Models:  append([]ModelDefinition{}, r.Models...),
+		Aliases: r.Aliases,
+	}
+	mapped := r.upstreamIDs()
+	for _, m := range models {
+		if r.byID[m.ID] == nil && !mapped[m.Upstream] {
+			merged.Models = append(merged.Models, m)
+		}
+	}
+	merged.index()
+	return merged
+}
+
+// upstreamIDs 返回注册表中已映射的上游模型 ID
+func (r *ModelRegistry) upstreamIDs() map[string]bool {
+	ids := make(map[string]bool, len(r.Models))
+	for _, m := range r.Models {
+		ids[m.Upstream] = true
+	}
+	return ids
+}
+
+// LoadModelRegistry 从 JSON 文件加载模型注册表
+func LoadModelRegistry(path string) (*ModelRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var registry ModelRegistry
+	if err := json.Unmarshal(data, &registry); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if err := registry.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	registry.index()
+	return &registry, nil
+}
+
+func (r *ModelRegistry) validate() error {
+	if len(r.Models) == 0 {
+		return fmt.Errorf("no models defined")
+	}
+	seen := make(map[string]bool)
+	for _, m := range r.Models {
+		if m.ID == "" || m.Upstream == "" {
+			return fmt.Errorf("model %q: id and upstream are required", m.ID)
+		}
+		if seen[m.ID] {
+			return fmt.Errorf("duplicate model %q", m.ID)
+		}
+		seen[m.ID] = true
+	}
+	for alias, target := range r.Aliases {
+		base, _, _ := ParseModelName(target)
+		if !seen[base] {
+			return fmt.Errorf("alias %q points to unknown model %q", alias, target)
+		}
+	}
+	return nil
+}
+
+func (r *ModelRegistry) index() {
+	r.byID = make(map[string]*ModelDefinition, len(r.Models))
+	for i := range r.Models {
+		r.byID[r.Models[i].ID] = &r.Models[i]
+	}
+}
+
+// Resolve 解析别名和 -thinking / -search 标签，别名本身也可以带标签，如 gpt-4o-thinking
+func (r *ModelRegistry) Resolve(model string) ResolvedModel {
+	name := model
+	if target, ok := r.Aliases[name]; ok {
+		name = target
+	}
+	base, thinking, search := ParseModelName(name)
+	if target, ok := r.Aliases[base]; ok {
+		targetBase, targetThinking, targetSearch := ParseModelName(target)
+		base, thinking, search = targetBase, thinking || targetThinking, search || targetSearch
+	}
+
+	def := r.byID[base]
+	if def == nil {
+		return ResolvedModel{Upstream: name, Thinking: thinking, Search: search}
+	}
+	return ResolvedModel{
+		Definition: def,
+		Upstream:   def.Upstream,
+		Thinking:   thinking && def.Capabilities.Thinking,
+		Search:     search && def.Capabilities.Search,
+	}
+}
+
+// ListModels 返回 /v1/models 中列出的模型，包括标签组合和别名
+func (r *ModelRegistry) ListModels() []ModelInfo {
+	var models []ModelInfo
+	for i := range r.Models {
+		m := &r.Models[i]
+		if m.Hidden {
+			continue
+		}
+		caps := m.Capabilities
+		models = append(models, ModelInfo{ID: m.ID, Object: "model", OwnedBy: "z.ai", Capabilities: &caps})
+		for _, variant := range m.Variants {
+			models = append(models, ModelInfo{ID: m.ID + "-" + variant, Object: "model", OwnedBy: "z.ai", Capabilities: &caps})
+		}
+	}
+
+	aliases := make([]string, 0, len(r.Aliases))
+	for alias := range r.Aliases {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		info := ModelInfo{ID: alias, Object: "model", OwnedBy: "z.ai"}
+		if def := r.Resolve(alias).Definition; def != nil {
+			caps := def.Capabilities
+			info.Capabilities = &caps
+		}
+		models = append(models, info)
+	}
+	return models
+}
+
+// InitModelRegistry 加载 MODELS_FILE，并定期检查文件修改时间以便无需重启即可生效
+func InitModelRegistry() {
+	if Cfg.ModelsFile == "" {
+		return
+	}
+	modelsFile = newFileWatcher(Cfg.ModelsFile, loadModelsFile)
+	if err := modelsFile.Reload(); err != nil {
+		LogError("Failed to load model registry, using built-in models: %v", err)
+	}
+	modelsFile.Watch(Cfg.ModelsReloadInterval, "model registry")
+}
+
+func loadModelsFile(path string) error {
+	registry, err := LoadModelRegistry(path)
+	if err != nil {
+		return err
+	}
+	setModelRegistry(registry)
+	LogInfo("Model registry loaded: %d models, %d aliases", len(registry.Models), len(registry.Aliases))
+	return nil
+}
+
+// HandleAdminModels 查看当前模型注册表，POST 立即重新加载 MODELS_FILE
+func HandleAdminModels(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, GetModelRegistry())
+	case http.MethodPost:
+		if modelsFile == nil {
+			writeAdminError(w, http.StatusNotFound, "MODELS_FILE is not configured")
+			return
+		}
+		if err := modelsFile.Reload(); err != nil {
+			LogError("Failed to reload model registry: %v", err)
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, GetModelRegistry())
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// features 返回上游请求的 features，注册表中的 features 覆盖默认值
+func (m ResolvedModel) features() map[string]interface{} {
+	features := map[string]interface{}{
+		"image_generation": false,
+		"web_search":       false,
+		"auto_web_search":  m.Search,
+		"preview_mode":     true,
+		"enable_thinking":  m.Thinking,
+	}
+	if m.Definition != nil {
+		for k, v := range m.Definition.Features {
+			features[k] = v
+		}
+	}
+	return features
+}
+
+func (m ResolvedModel) mcpServers() []string {
+	if m.Definition == nil {
+		return nil
+	}
+	return m.Definition.MCPServers
+}
@@ -0,0 +1,240 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// 结束原因，由各协议的 renderer 转换为自己的取值
+const (
+	finishStop      = "stop"
+	finishToolCalls = "tool_calls"
+	// 上游出错或中途断开，回答不完整
+	finishError = "error"
+)
+
+// responseRenderer 将处理后的输出写成某种协议的响应
+type responseRenderer interface {
+	Reasoning(text string)
+	Text(text string)
+	ToolCall(call ToolCall)
+	// Finish 在上游正常结束后调用，reason 为 stop / tool_calls / length / stop_sequence
+	Finish(reason, stopSequence string)
+	// Error 在上游返回错误、中途断开或读取失败时调用，之后不再调用 Finish
+	Error(err error)
+}
+
+// readFailure 是读取上游失败时需要告知客户端的错误
+type readFailure struct {
+	// 非流式响应使用的 HTTP 状态码
+	status  int
+	code    string
+	message string
+}
+
+// classifyReadError 返回需要告知客户端的错误，客户端已断开时返回 nil
+func classifyReadError(err error) *readFailure {
+	var upstreamErr *UpstreamError
+	switch {
+	case err == errUpstreamTimeout:
+		return &readFailure{http.StatusGatewayTimeout, "upstream_timeout", "Upstream timed out"}
+	case errors.Is(err, errSSEEventTooLarge):
+		return &readFailure{http.StatusBadGateway, "upstream_event_too_large", fmt.Sprintf("Upstream response event is too large (UPSTREAM_MAX_EVENT_SIZE=%d)", Cfg.UpstreamMaxEventSize)}
+	case errors.As(err, &upstreamErr):
+		return &readFailure{http.StatusBadGateway, "upstream_error", "Upstream error: " + upstreamErr.Message}
+	case errors.Is(err, context.Canceled):
+		return nil
+	}
+	// 未收到结束标记或连接被重置，回答不完整
+	return &readFailure{http.StatusBadGateway, "upstream_truncated", "Upstream stream ended unexpectedly"}
+}
+
+// eventPipeline 对上游事件做引用替换、工具调用提取和输出限制，再交给 renderer
+type eventPipeline struct {
+	renderer      responseRenderer
+	refs          *SearchRefFilter
+	reasoningRefs *SearchRefFilter
+	tools         *ToolCallFilter
+	limiter       *OutputLimiter
+	// 为 true 时丢弃思考内容，如 Claude 请求未开启 thinking
+	dropReasoning bool
+	// 引用来源和图片搜索结果的 markdown，在下一段正文之前输出
+	pendingCitations string
+	pendingImages    string
+	hasContent       bool
+}
+
+func newEventPipeline(renderer responseRenderer, opts *responseOptions) *eventPipeline {
+	p := &eventPipeline{
+		renderer:      renderer,
+		refs:          NewSearchRefFilter(),
+		reasoningRefs: NewSearchRefFilter(),
+		limiter:       newOutputLimiter(opts.maxTokens, opts.reasoningBudget, opts.stopSequences),
+	}
+	if opts.toolsEnabled {
+		p.tools = &ToolCallFilter{}
+	}
+	return p
+}
+
+// Run 读取上游直到结束，达到 max_tokens 或命中停止序列后立即关闭上游连接
+func (p *eventPipeline) Run(body io.ReadCloser) {
+	events := newUpstreamEventReader(body)
+	for !p.limiter.Stopped() {
+		event := events.Next()
+		if event.Type == EventDone {
+			break
+		}
+		if event.Type == EventError {
+			if failure := classifyReadError(event.Err); failure != nil {
+				metrics.Inc("zai_upstream_stream_errors_total", "code", failure.code)
+			}
+			p.renderer.Error(event.Err)
+			return
+		}
+		p.handle(event)
+	}
+	if p.limiter.Stopped() {
+		body.Close()
+	}
+	p.finish()
+}
+
+func (p *eventPipeline) handle(event UpstreamEvent) {
+	switch event.Type {
+	case EventReasoning:
+		if !p.dropReasoning {
+			p.reasoning(p.reasoningRefs.Process(event.Text))
+		}
+	case EventText:
+		p.flushReasoning()
+		p.flushPending()
+		p.text(p.refs.Process(event.Text))
+	case EventCitations:
+		p.refs.AddSearchResults(event.Citations)
+		p.reasoningRefs.AddSearchResults(event.Citations)
+		p.pendingCitations = p.refs.GetSearchResultsMarkdown()
+	case EventImages:
+		p.pendingImages = FormatImageSearchResults(event.Images)
+	case EventToolActivity:
+		if tool := event.Block.Tool; tool != nil {
+			LogDebug("[Upstream] Tool activity: %s %s (%s)", event.Block.Type, tool.Name, tool.Status)
+		} else {
+			LogDebug("[Upstream] Unhandled glm_block: type=%q", event.Block.Type)
+		}
+	}
+}
+
+func (p *eventPipeline) reasoning(text string) {
+	text = p.limiter.Reasoning(text)
+	if text == "" {
+		return
+	}
+	p.hasContent = true
+	p.renderer.Reasoning(text)
+}
+
+// flushReasoning 在思考转为正文时输出思考中暂存的不完整引用标记
+func (p *eventPipeline) flushReasoning() {
+	if rest := p.reasoningRefs.Flush(); rest != "" && !p.dropReasoning {
+		p.reasoning(rest)
+	}
+}
+
+func (p *eventPipeline) flushPending() {
+	pending := p.pendingCitations + p.pendingImages
+	p.pendingCitations, p.pendingImages = "", ""
+	p.output(p.limiter.Content(pending))
+}
+
+// text 从正文中提取工具调用，其余文本经过输出限制后交给 renderer
+func (p *eventPipeline) text(text string) {
+	var calls []ToolCall
+	if p.tools != nil {
+		text, calls = p.tools.Process(text)
+	}
+	p.output(p.limiter.Content(text))
+	p.toolCalls(calls)
+}
+
+func (p *eventPipeline) toolCalls(calls []ToolCall) {
+	for _, call := range calls {
+		p.hasContent = true
+		p.renderer.ToolCall(call)
+	}
+}
+
+func (p *eventPipeline) output(text string) {
+	if text == "" {
+		return
+	}
+	p.hasContent = true
+	p.renderer.Text(text)
+}
+
+func (p *eventPipeline) finish() {
+	p.flushReasoning()
+	p.text(p.refs.Flush())
+	if p.tools != nil {
+		rest, calls := p.tools.Flush()
+		p.output(p.limiter.Content(rest))
+		p.toolCalls(calls)
+	}
+	p.flushPending()
+	// 停止序列匹配时暂存的尾部文本
+	p.output(p.limiter.Flush())
+
+	if !p.hasContent {
+		LogError("Upstream response 200 but no content received")
+	}
+
+	reason := finishStop
+	if p.tools != nil && p.tools.HasCalls() {
+		reason = finishToolCalls
+	} else if p.limiter.Stopped() {
+		reason = p.limiter.Reason()
+	}
+	p.renderer.Finish(reason, p.limiter.StopSequence())
+}
+
+// nonStreamCollector 汇总输出，供 OpenAI 和 Claude 的非流式响应使用
+type nonStreamCollector struct {
+	content   strings.Builder
+	reasoning strings.Builder
+	result    nonStreamResult
+}
+
+func (c *nonStreamCollector) Reasoning(text string) { c.reasoning.WriteString(text) }
+func (c *nonStreamCollector) Text(text string)      { c.content.WriteString(text) }
+func (c *nonStreamCollector) Error(err error)       { c.result.err = err }
+
+func (c *nonStreamCollector) ToolCall(call ToolCall) {
+	// 非流式响应中的 ToolCall 不带 Index
+	call.Index = nil
+	c.result.toolCalls = append(c.result.toolCalls, call)
+}
+
+func (c *nonStreamCollector) Finish(reason, stopSequence string) {
+	c.result.content = c.content.String()
+	if len(c.result.toolCalls) > 0 {
+		c.result.content = strings.TrimSpace(c.result.content)
+	}
+	c.result.reasoning = c.reasoning.String()
+	if reason == limitReasonLength || reason == limitReasonStopSequence {
+		c.result.limitReason = reason
+		c.result.stopSequence = stopSequence
+	}
+}
+
+// collectResponse 读取全部上游输出，读取失败时 result.err 不为空
+func collectResponse(body io.ReadCloser, opts *responseOptions, dropReasoning bool) *nonStreamResult {
+	collector := &nonStreamCollector{}
+	pipeline := newEventPipeline(collector, opts)
+	pipeline.dropReasoning = dropReasoning
+	pipeline.Run(body)
+	return &collector.result
+}
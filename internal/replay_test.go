@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// go test ./internal -run TestReplay -update 重新生成 golden 文件
+var updateGolden = flag.Bool("update", false, "rewrite replay golden files with current output")
+
+// replayRenderers 是回放时依次使用的响应处理函数
+var replayRenderers = []string{"openai-stream", "openai", "claude-stream", "claude"}
+
+var (
+	replayCreatedPattern = regexp.MustCompile(`"created":\d+`)
+	replayCallIDPattern  = regexp.MustCompile(`"(call|toolu)_[0-9a-f]{24}"`)
+)
+
+// TestReplay 将 testdata/replay 中录制的上游 SSE 依次输入四个响应处理函数，并与 golden 文件比较
+func TestReplay(t *testing.T) {
+	recordings, err := filepath.Glob(filepath.Join("testdata", "replay", "*.sse"))
+	if err != nil || len(recordings) == 0 {
+		t.Fatalf("no recordings found in testdata/replay")
+	}
+
+	for _, path := range recordings {
+		path := path
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".sse"), func(t *testing.T) {
+			outputs, err := replayRecording(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, renderer := range replayRenderers {
+				golden := strings.TrimSuffix(path, ".sse") + "." + renderer + ".golden"
+				if *updateGolden {
+					if err := os.WriteFile(golden, outputs[renderer], 0644); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				expected, err := os.ReadFile(golden)
+				if err != nil {
+					t.Errorf("%s: %v (run with -update)", filepath.Base(golden), err)
+					continue
+				}
+				if diff := firstDiff(expected, outputs[renderer]); diff != "" {
+					t.Errorf("%s differs from golden\n%s", filepath.Base(golden), diff)
+				}
+			}
+		})
+	}
+}
+
+// replayRecording 回放单个录制文件，返回各响应处理函数规范化后的输出
+func replayRecording(path string) (map[string][]byte, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var meta RecordingMeta
+	metaPath := strings.TrimSuffix(path, ".sse") + ".meta.json"
+	if data, err := os.ReadFile(metaPath); err == nil {
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Base(metaPath), err)
+		}
+	}
+	if meta.TargetModel == "" {
+		meta.TargetModel = "replay-model"
+	}
+
+	outputs := make(map[string][]byte)
+	for _, renderer := range replayRenderers {
+		opts := &responseOptions{
+			thinkingEnabled: meta.Thinking,
+			toolsEnabled:    meta.Tools,
+			includeUsage:    true,
+		}
+		body := io.NopCloser(bytes.NewReader(raw))
+		rec := httptest.NewRecorder()
+		switch renderer {
+		case "openai-stream":
+			handleStreamResponse(rec, body, "chatcmpl-replay", meta.TargetModel, opts)
+		case "openai":
+			handleNonStreamResponse(rec, body, "chatcmpl-replay", meta.TargetModel, opts)
+		case "claude-stream":
+			handleClaudeStreamResponse(rec, body, "msg_replay", meta.Model, opts)
+		case "claude":
+			handleClaudeNonStreamResponse(rec, body, "msg_replay", meta.Model, opts)
+		}
+		outputs[renderer] = normalizeReplayOutput(rec.Body.Bytes())
+	}
+	return outputs, nil
+}
+
+// 替换时间戳和随机生成的工具调用 ID，使输出可以稳定比较
+func normalizeReplayOutput(output []byte) []byte {
+	output = replayCreatedPattern.ReplaceAll(output, []byte(`"created":0`))
+	return replayCallIDPattern.ReplaceAll(output, []byte(`"${1}_replay"`))
+}
+
+// firstDiff 返回第一处不同的行，相同时返回空字符串
+func firstDiff(expected, actual []byte) string {
+	if bytes.Equal(expected, actual) {
+		return ""
+	}
+	expLines := strings.Split(string(expected), "\n")
+	actLines := strings.Split(string(actual), "\n")
+	for i := 0; i < len(expLines) || i < len(actLines); i++ {
+		var exp, act string
+		if i < len(expLines) {
+			exp = expLines[i]
+		}
+		if i < len(actLines) {
+			act = actLines[i]
+		}
+		if exp != act {
+			return fmt.Sprintf("  line %d:\n  - %s\n  + %s", i+1, exp, act)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// OpenAI 格式的 response_format
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+type JSONSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      bool            `json:"strict,omitempty"`
+}
+
+// jsonOutputSpec 是解析后的结构化输出要求
+type jsonOutputSpec struct {
+	format *ResponseFormat
+	schema *JSONSchema
+}
+
+// newJSONOutputSpec 解析 response_format，text 或未设置时返回 nil
+func newJSONOutputSpec(format *ResponseFormat) (*jsonOutputSpec, error) {
+	if format == nil {
+		return nil, nil
+	}
+	switch format.Type {
+	case "", "text":
+		return nil, nil
+	case "json_object":
+		return &jsonOutputSpec{format: format}, nil
+	case "json_schema":
+		if format.JSONSchema == nil || len(format.JSONSchema.Schema) == 0 {
+			return nil, fmt.Errorf("response_format.json_schema.schema is required")
+		}
+		schema, err := ParseJSONSchema(format.JSONSchema.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid response_format.json_schema.schema: %v", err)
+		}
+		return &jsonOutputSpec{format: format, schema: schema}, nil
+	}
+	return nil, fmt.Errorf("unsupported response_format type %q", format.Type)
+}
+
+// 构建注入到 system 中的 JSON 输出说明
+func (s *jsonOutputSpec) prompt() string {
+	var sb strings.Builder
+	sb.WriteString("You must reply with a single valid JSON object and nothing else: ")
+	sb.WriteString("no explanations, no markdown code fences, no text before or after the JSON.")
+	if s.schema != nil {
+		if s.format.JSONSchema.Description != "" {
+			sb.WriteString("\n\nThe JSON describes: " + s.format.JSONSchema.Description)
+		}
+		sb.WriteString("\n\nThe JSON must conform to this JSON Schema")
+		if s.format.JSONSchema.Name != "" {
+			sb.WriteString(fmt.Sprintf(" (%s)", s.format.JSONSchema.Name))
+		}
+		sb.WriteString(":\n")
+		sb.WriteString(compactJSON(s.format.JSONSchema.Schema))
+	}
+	return sb.String()
+}
+
+// applyPrompt 将 JSON 输出说明合并到 system 消息
+func (s *jsonOutputSpec) applyPrompt(messages []Message) []Message {
+	prompt := s.prompt()
+	if len(messages) > 0 && messages[0].Role == "system" {
+		text, _ := messages[0].ParseContent()
+		return append([]Message{{Role: "system", Content: text + "\n\n" + prompt}}, messages[1:]...)
+	}
+	return append([]Message{{Role: "system", Content: prompt}}, messages...)
+}
+
+// retryMessages 在原始对话后追加上次的错误输出和纠正提示
+func (s *jsonOutputSpec) retryMessages(messages []Message, lastContent string, validationErr error) []Message {
+	retry := append([]Message{}, messages...)
+	retry = append(retry,
+		Message{Role: "assistant", Content: lastContent},
+		Message{Role: "user", Content: fmt.Sprintf(
+			"Your previous reply was rejected: %v. Reply again with only the corrected JSON.", validationErr)},
+	)
+	return retry
+}
+
+// Validate 校验并规范化模型输出，返回去除代码块标记后的 JSON 文本
+func (s *jsonOutputSpec) Validate(content string) (string, error) {
+	normalized := normalizeJSONContent(content)
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(normalized), &value); err != nil {
+		return normalized, fmt.Errorf("output is not valid JSON: %v", err)
+	}
+	if s.schema == nil {
+		if _, ok := value.(map[string]interface{}); !ok {
+			return normalized, fmt.Errorf("output is not a JSON object")
+		}
+		return normalized, nil
+	}
+	if err := s.schema.Validate(value); err != nil {
+		return normalized, fmt.Errorf("output does not match schema: %v", err)
+	}
+	return normalized, nil
+}
+
+// normalizeJSONContent 去除 markdown 代码块标记，必要时截取首尾大括号之间的内容
+func normalizeJSONContent(content string) string {
+	content = strings.TrimSpace(content)
+	if strings.HasPrefix(content, "```") {
+		if idx := strings.Index(content, "\n"); idx != -1 {
+			content = content[idx+1:]
+		} else {
+			content = strings.TrimPrefix(content, "```")
+		}
+		content = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(content), "```"))
+	}
+	if json.Valid([]byte(content)) {
+		return content
+	}
+	start := strings.IndexAny(content, "{[")
+	end := strings.LastIndexAny(content, "}]")
+	if start != -1 && end > start && json.Valid([]byte(content[start:end+1])) {
+		return content[start : end+1]
+	}
+	return content
+}
+
+// JSONFenceFilter 在流式输出中去除包裹 JSON 的 markdown 代码块标记
+type JSONFenceFilter struct {
+	started bool
+	head    string
+	tail    string
+}
+
+func (f *JSONFenceFilter) Process(content string) string {
+	if !f.started {
+		f.head += content
+		trimmed := strings.TrimLeft(f.head, " \t\r\n")
+		if trimmed == "" || (len(trimmed) < 3 && strings.HasPrefix("```", trimmed)) {
+			return ""
+		}
+		if strings.HasPrefix(trimmed, "```") {
+			idx := strings.Index(trimmed, "\n")
+			if idx == -1 {
+				return ""
+			}
+			trimmed = trimmed[idx+1:]
+		}
+		f.started = true
+		f.head = ""
+		content = trimmed
+	}
+
+	content = f.tail + content
+	// 末尾的空白和反引号可能是结束标记，暂存到下一次
+	cut := len(strings.TrimRight(content, " \t\r\n`"))
+	f.tail = content[cut:]
+	return content[:cut]
+}
+
+func (f *JSONFenceFilter) Flush() string {
+	if !f.started {
+		result := strings.TrimSpace(f.head)
+		f.head = ""
+		return result
+	}
+	f.tail = ""
+	return ""
+}
+
+// enforce 校验非流式结果，失败时最多重试 Cfg.JSONMaxRetries 次，仍失败则返回 refusal
+func (s *jsonOutputSpec) enforce(result *nonStreamResult, messages []Message, retry func([]Message) (*nonStreamResult, error)) *nonStreamResult {
+	for attempt := 0; ; attempt++ {
+		normalized, err := s.Validate(result.content)
+		if err == nil {
+			result.content = normalized
+			return result
+		}
+		if retry == nil || attempt >= Cfg.JSONMaxRetries {
+			LogWarn("[JSON] Output failed validation after %d attempt(s): %v", attempt+1, err)
+			return &nonStreamResult{
+				reasoning: result.reasoning,
+				refusal:   fmt.Sprintf("The model did not produce valid JSON: %v", err),
+			}
+		}
+
+		LogWarn("[JSON] Output failed validation (attempt %d): %v, retrying", attempt+1, err)
+		next, retryErr := retry(s.retryMessages(messages, result.content, err))
+		if retryErr != nil {
+			LogError("[JSON] Retry request failed: %v", retryErr)
+			return &nonStreamResult{
+				reasoning: result.reasoning,
+				refusal:   fmt.Sprintf("The model did not produce valid JSON: %v", err),
+			}
+		}
+		result = next
+	}
+}
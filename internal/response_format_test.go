@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJSONFenceFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"plain JSON", []string{`{"a":`, `1}`}, `{"a":1}`},
+		{"fenced JSON", []string{"```json\n{\"a\":1}\n```"}, `{"a":1}`},
+		{"opening fence split across chunks", []string{"`", "``js", "on\n{\"a\"", ":1}\n``", "`"}, `{"a":1}`},
+		{"fence without language", []string{"```\n[1,2]\n```\n"}, `[1,2]`},
+		{"leading whitespace", []string{"\n  ", "{\"a\":1}"}, `{"a":1}`},
+		{"backticks inside a string are kept", []string{"{\"a\":\"`x`", "\"}"}, "{\"a\":\"`x`\"}"},
+		{"only a partial fence", []string{"``"}, "``"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := &JSONFenceFilter{}
+			var out strings.Builder
+			for _, chunk := range tt.chunks {
+				out.WriteString(filter.Process(chunk))
+			}
+			out.WriteString(filter.Flush())
+			if got := out.String(); got != tt.want {
+				t.Fatalf("output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewJSONOutputSpecRejectsInvalidPattern(t *testing.T) {
+	format := &ResponseFormat{
+		Type: "json_schema",
+		JSONSchema: &JSONSchemaFormat{
+			Name:   "code",
+			Schema: []byte(`{"type":"object","properties":{"code":{"type":"string","pattern":"[0-9"}}}`),
+		},
+	}
+	if _, err := newJSONOutputSpec(format); err == nil || !strings.Contains(err.Error(), "invalid pattern") {
+		t.Fatalf("error = %v, want invalid pattern", err)
+	}
+}
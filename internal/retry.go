@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// peekedBody 先返回已预读的内容，再继续读取原始响应体
+type peekedBody struct {
+	io.Reader
+	body io.ReadCloser
+}
+
+func (b *peekedBody) Close() error {
+	return b.body.Close()
+}
+
+// sendUpstream 发送上游请求，在网络错误、429 和 5xx 时按指数退避重试，
+// 账号池中的账号出错时换用其他账号；只有收到首字节后才把响应交给调用方，
+// 因此重试都发生在向客户端写入任何内容之前。
+// 最后一次尝试的非 200 响应会原样返回，由调用方生成错误响应。
+// 各次尝试共用 images 中已上传的图片
+func sendUpstream(ctx context.Context, lease *tokenLease, messages []Message, model string, images *imageUploads) (*http.Response, string, error) {
+	tried := make(map[*PooledToken]bool)
+	for attempt := 0; ; attempt++ {
+		if lease.pooled != nil {
+			tried[lease.pooled] = true
+		}
+
+		resp, targetModel, err := makeUpstreamRequest(withUpstreamProxy(ctx, lease.Proxy), lease.Token, messages, model, images)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			err = peekFirstByte(resp)
+			if err != nil {
+				resp.Body.Close()
+				resp = nil
+			}
+		}
+		if err == errInvalidToken || (err != nil && isClientGone(ctx, err)) {
+			return nil, "", err
+		}
+
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+			checkVersionMismatch(resp)
+		}
+		lease.Report(status, err)
+		metrics.Inc("zai_upstream_requests_total", "result", upstreamResult(status, err))
+
+		if err == nil && status == http.StatusOK {
+			if attempt > 0 {
+				LogInfo("[Retry] Upstream succeeded after %d retries", attempt)
+			}
+			return resp, targetModel, nil
+		}
+
+		// 认证失败换账号后可以重试，其他情况只重试临时错误
+		authFailed := status == http.StatusUnauthorized || status == http.StatusForbidden
+		if attempt >= Cfg.UpstreamMaxRetries ||
+			!(isRetryableStatus(status, err) || (authFailed && (lease.pooled != nil || lease.anonymous))) {
+			return resp, targetModel, err
+		}
+
+		switchedToken := lease.failover(ctx, tried)
+		if authFailed && !switchedToken {
+			return resp, targetModel, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		delay := retryBackoff(attempt)
+		LogWarn("[Retry] Upstream attempt %d/%d failed (%s), retrying in %s",
+			attempt+1, Cfg.UpstreamMaxRetries+1, describeUpstreamFailure(status, err), delay)
+		metrics.Inc("zai_upstream_retries_total")
+		if switchedToken {
+			metrics.Inc("zai_upstream_failovers_total")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// peekFirstByte 等待响应体的首字节，超时或空响应视为失败以便重试
+func peekFirstByte(resp *http.Response) error {
+	reader := bufio.NewReader(resp.Body)
+	if _, err := reader.Peek(1); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	resp.Body = &peekedBody{Reader: reader, body: resp.Body}
+	return nil
+}
+
+func isRetryableStatus(status int, err error) bool {
+	if err != nil {
+		return true
+	}
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// retryBackoff 返回第 attempt 次失败后的等待时间：指数增长，上限 UPSTREAM_RETRY_MAX_BACKOFF，并加入随机抖动
+func retryBackoff(attempt int) time.Duration {
+	delay := Cfg.UpstreamRetryBackoff << uint(min(attempt, 10))
+	if delay > Cfg.UpstreamRetryMaxBackoff {
+		delay = Cfg.UpstreamRetryMaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	// 在 [delay/2, delay) 之间随机
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func upstreamResult(status int, err error) string {
+	switch {
+	case err == errUpstreamTimeout:
+		return "timeout"
+	case err != nil:
+		return "network_error"
+	case status == http.StatusOK:
+		return "success"
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return "auth_error"
+	case status == http.StatusTooManyRequests:
+		return "rate_limited"
+	case status >= 500:
+		return "server_error"
+	}
+	return "client_error"
+}
+
+func describeUpstreamFailure(status int, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return http.StatusText(status)
+}
@@ -1,33 +1,305 @@
 package internal
 
 import (
+	"bufio"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
+// SignParams 是一次对话请求中参与签名和拼接 URL 的字段
+type SignParams struct {
+	UserID    string
+	RequestID string
+	ChatID    string
+	Token     string
+	Content   string
+	Timestamp int64
+}
+
+// Signer 生成上游对话接口的 X-Signature 和查询参数
+type Signer interface {
+	Sign(p SignParams) string
+	QueryString(p SignParams) string
+}
+
+// SignerConfig 描述 HMAC 签名方案，可从 SIGNER_FILE 加载
+type SignerConfig struct {
+	Key string `json:"key"`
+	// 第一次 HMAC 使用的时间窗口，如 "5m"
+	Period string `json:"period"`
+	// 参与签名的请求字段，按顺序拼接为 name,value,name,value
+	Fields []string `json:"fields"`
+	// URL 中的 version 参数
+	Version string `json:"version"`
+	// 查询参数模板，形如 "name={变量}" 或 "name=固定值"，只写 "name" 等同于 "name={name}"
+	Query []string `json:"query"`
+}
+
+// defaultSignerConfig 是 z.ai 前端当前使用的签名方案
+var defaultSignerConfig = SignerConfig{
+	Key:     "key-@@@@)))()((9))-xxxx&&&%%%%%",
+	Period:  "5m",
+	Fields:  []string{"requestId", "timestamp", "user_id"},
+	Version: "0.0.1",
+	Query: []string{
+		"timestamp", "requestId", "user_id", "version", "platform=web", "token",
+		"current_url", "pathname", "signature_timestamp={timestamp}",
+	},
+}
+
+// HMACSigner 先用 key 对时间窗口做 HMAC，再用结果对请求字段、内容和时间戳做 HMAC
+type HMACSigner struct {
+	config SignerConfig
+	period time.Duration
+}
+
+func NewHMACSigner(config SignerConfig) (*HMACSigner, error) {
+	if config.Key == "" {
+		return nil, fmt.Errorf("key is required")
+	}
+	period, err := time.ParseDuration(config.Period)
+	if err != nil || period < time.Millisecond {
+		return nil, fmt.Errorf("invalid period %q", config.Period)
+	}
+	if len(config.Fields) == 0 || len(config.Query) == 0 {
+		return nil, fmt.Errorf("fields and query are required")
+	}
+	for _, field := range config.Fields {
+		if !signerVariables[field] {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+	}
+	return &HMACSigner{config: config, period: period}, nil
+}
+
+// signerVariables 是签名字段和查询参数模板中可用的变量
+var signerVariables = map[string]bool{
+	"timestamp": true, "requestId": true, "user_id": true, "chat_id": true,
+	"token": true, "version": true, "current_url": true, "pathname": true,
+}
+
+func (s *HMACSigner) variables(p SignParams) map[string]string {
+	return map[string]string{
+		"timestamp":   fmt.Sprintf("%d", p.Timestamp),
+		"requestId":   p.RequestID,
+		"user_id":     p.UserID,
+		"chat_id":     p.ChatID,
+		"token":       p.Token,
+		"version":     s.config.Version,
+		"current_url": upstreamURL("/c/" + p.ChatID),
+		"pathname":    "/c/" + p.ChatID,
+	}
+}
+
+// Config 返回签名方案的配置，key 已脱敏
+func (s *HMACSigner) Config() SignerConfig {
+	config := s.config
+	config.Key = maskToken(config.Key)
+	return config
+}
+
 func hmacSha256Hex(key []byte, data string) string {
 	h := hmac.New(sha256.New, key)
 	h.Write([]byte(data))
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-func GenerateSignature(userID, requestID, userContent string, timestamp int64) string {
-	requestInfo := fmt.Sprintf("requestId,%s,timestamp,%d,user_id,%s", requestID, timestamp, userID)
-	contentBase64 := base64.StdEncoding.EncodeToString([]byte(userContent))
-	signData := fmt.Sprintf("%s|%s|%d", requestInfo, contentBase64, timestamp)
+func (s *HMACSigner) Sign(p SignParams) string {
+	vars := s.variables(p)
+	var info []string
+	for _, field := range s.config.Fields {
+		info = append(info, field, vars[field])
+	}
+	requestInfo := strings.Join(info, ",")
+	contentBase64 := base64.StdEncoding.EncodeToString([]byte(p.Content))
+	signData := fmt.Sprintf("%s|%s|%d", requestInfo, contentBase64, p.Timestamp)
 
-	period := timestamp / (5 * 60 * 1000)
+	period := p.Timestamp / s.period.Milliseconds()
 	// 两次加密均返回 hex 字符串
-	firstHmac := hmacSha256Hex([]byte("key-@@@@)))()((9))-xxxx&&&%%%%%"), fmt.Sprintf("%d", period))
-	signature := hmacSha256Hex([]byte(firstHmac), signData)
+	firstHmac := hmacSha256Hex([]byte(s.config.Key), fmt.Sprintf("%d", period))
+	return hmacSha256Hex([]byte(firstHmac), signData)
+}
+
+// QueryString 按模板拼接查询参数，与前端一致不做转义
+func (s *HMACSigner) QueryString(p SignParams) string {
+	vars := s.variables(p)
+	params := make([]string, 0, len(s.config.Query))
+	for _, item := range s.config.Query {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			value = "{" + name + "}"
+		}
+		for k, v := range vars {
+			value = strings.ReplaceAll(value, "{"+k+"}", v)
+		}
+		params = append(params, name+"="+value)
+	}
+	return strings.Join(params, "&")
+}
 
-	// LogDebug("[Signature] requestInfo=%s", requestInfo)
-	// LogDebug("[Signature] userContent=%s", userContent)
-	// LogDebug("[Signature] timestamp=%d", timestamp)
-	// LogDebug("[Signature] signature=%s", signature)
+var (
+	signer     Signer = mustDefaultSigner()
+	signerLock sync.RWMutex
+	signerFile *fileWatcher
+)
+
+func mustDefaultSigner() Signer {
+	s, err := NewHMACSigner(defaultSignerConfig)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// GetSigner 返回当前生效的签名方案
+func GetSigner() Signer {
+	signerLock.RLock()
+	defer signerLock.RUnlock()
+	return signer
+}
+
+// InitSigner 加载 SIGNER_FILE，未设置的字段使用默认方案，并在文件修改后自动重新加载
+func InitSigner() {
+	if Cfg.SignerFile == "" {
+		return
+	}
+	signerFile = newFileWatcher(Cfg.SignerFile, loadSignerFile)
+	if err := signerFile.Reload(); err != nil {
+		LogError("Failed to load signer config, using built-in scheme: %v", err)
+	}
+	signerFile.Watch(Cfg.SignerReloadInterval, "signer config")
+}
+
+func loadSignerFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// 复制默认值中的切片，避免 Unmarshal 复用其底层数组
+	config := defaultSignerConfig
+	config.Fields = append([]string(nil), config.Fields...)
+	config.Query = append([]string(nil), config.Query...)
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	s, err := NewHMACSigner(config)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", path, err)
+	}
+
+	signerLock.Lock()
+	signer = s
+	signerLock.Unlock()
+	LogInfo("Signer config loaded: period=%s, fields=%s, version=%s", config.Period, strings.Join(config.Fields, ","), config.Version)
+	return nil
+}
+
+// signerTestResult 是签名自检的结果
+type signerTestResult struct {
+	OK        bool   `json:"ok"`
+	Status    int    `json:"status,omitempty"`
+	Model     string `json:"model"`
+	FeVersion string `json:"fe_version"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// testSigner 使用匿名 token 向上游发送一条最短的对话请求，收到正常的 SSE 事件即认为签名有效
+func testSigner(ctx context.Context) (result signerTestResult) {
+	result = signerTestResult{Model: GetModelRegistry().Models[0].ID, FeVersion: GetFeVersion()}
+	start := time.Now()
+	defer func() { result.LatencyMs = time.Since(start).Milliseconds() }()
+
+	token, err := AnonTokens.Get(ctx)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to get anonymous token: %v", err)
+		return result
+	}
+	resp, _, err := makeUpstreamRequest(ctx, token, []Message{{Role: "user", Content: "ping"}}, result.Model, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	result.Status = resp.StatusCode
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+		result.Error = strings.TrimSpace(string(body))
+		return result
+	}
+
+	// 只读取第一条 data 事件
+	reader := bufio.NewReader(io.LimitReader(resp.Body, 64*1024))
+	for {
+		line, err := reader.ReadString('\n')
+		if data, ok := strings.CutPrefix(strings.TrimSpace(line), "data: "); ok {
+			if strings.Contains(data, `"error"`) {
+				result.Error = data
+			} else {
+				result.OK = true
+			}
+			break
+		}
+		if err != nil {
+			result.Error = fmt.Sprintf("no event received: %v", err)
+			break
+		}
+	}
+	return result
+}
+
+// HandleAdminSigner 查看当前签名方案，POST 立即重新加载 SIGNER_FILE；
+// /admin/signer/test 用当前方案向上游发送一次请求进行自检
+func HandleAdminSigner(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(w, r) {
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/admin/signer/test":
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+		result := testSigner(ctx)
+		if result.OK {
+			LogInfo("[Signer] Self-test passed in %dms", result.LatencyMs)
+		} else {
+			LogWarn("[Signer] Self-test failed: status=%d, error=%s", result.Status, result.Error)
+		}
+		writeAdminJSON(w, http.StatusOK, result)
+	case r.Method == http.MethodGet:
+		writeSignerConfig(w)
+	case r.Method == http.MethodPost:
+		if signerFile == nil {
+			writeAdminError(w, http.StatusNotFound, "SIGNER_FILE is not configured")
+			return
+		}
+		if err := signerFile.Reload(); err != nil {
+			LogError("Failed to reload signer config: %v", err)
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeSignerConfig(w)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
 
-	return signature
+func writeSignerConfig(w http.ResponseWriter) {
+	if s, ok := GetSigner().(*HMACSigner); ok {
+		writeAdminJSON(w, http.StatusOK, s.Config())
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]string{"type": fmt.Sprintf("%T", GetSigner())})
 }
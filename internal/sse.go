@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// errSSEEventTooLarge 表示单个上游事件超过 UPSTREAM_MAX_EVENT_SIZE
+var errSSEEventTooLarge = errors.New("upstream event too large")
+
+// SSEEvent 是一个 Server-Sent Events 事件
+type SSEEvent struct {
+	// event: 字段，未设置时为空
+	Event string
+	// 最近一次 id: 字段的值，按规范在后续事件中沿用
+	ID string
+	// 多行 data: 以 "\n" 连接
+	Data string
+}
+
+// sseReader 按 SSE 规范逐个解码事件，单行长度不受缓冲区限制
+type sseReader struct {
+	reader *bufio.Reader
+	// 单个事件（包括正在读取的行）允许占用的最大字节数，<= 0 表示不限制
+	maxSize int
+	lastID  string
+}
+
+func newSSEReader(r io.Reader, maxSize int) *sseReader {
+	return &sseReader{reader: bufio.NewReaderSize(r, 64*1024), maxSize: maxSize}
+}
+
+// Next 返回下一个事件，流正常结束时返回 io.EOF。
+// 流结束时尚未以空行结束的事件仍会返回，上游最后一个事件可能省略空行
+func (r *sseReader) Next() (SSEEvent, error) {
+	var data bytes.Buffer
+	event := SSEEvent{}
+	hasData := false
+	for {
+		line, err := r.readLine(data.Len())
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			if err == io.EOF && hasData {
+				break
+			}
+			return SSEEvent{}, err
+		}
+
+		if len(line) == 0 {
+			// 空行结束一个事件，没有 data 的事件按规范忽略
+			if hasData {
+				break
+			}
+			event.Event = ""
+			continue
+		}
+		if line[0] == ':' {
+			continue
+		}
+
+		field, value := line, []byte(nil)
+		if idx := bytes.IndexByte(line, ':'); idx != -1 {
+			field, value = line[:idx], line[idx+1:]
+			value = bytes.TrimPrefix(value, []byte(" "))
+		}
+		switch string(field) {
+		case "data":
+			if hasData {
+				data.WriteByte('\n')
+			}
+			data.Write(value)
+			hasData = true
+		case "event":
+			event.Event = string(value)
+		case "id":
+			if bytes.IndexByte(value, 0) == -1 {
+				r.lastID = string(value)
+			}
+		}
+
+		if err == io.EOF {
+			if !hasData {
+				return SSEEvent{}, io.EOF
+			}
+			break
+		}
+	}
+
+	event.ID = r.lastID
+	event.Data = data.String()
+	return event, nil
+}
+
+// readLine 读取一行并去掉行尾的 "\n" 或 "\r\n"，pending 是当前事件已占用的字节数
+func (r *sseReader) readLine(pending int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		if r.maxSize > 0 && pending+len(line)+len(chunk) > r.maxSize {
+			return nil, fmt.Errorf("%w: exceeds %d bytes", errSSEEventTooLarge, r.maxSize)
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		return line, err
+	}
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestSSEReader(t *testing.T) {
+	long := strings.Repeat("x", 100*1024)
+	tests := []struct {
+		name    string
+		stream  string
+		maxSize int
+		want    []SSEEvent
+		wantErr error
+	}{
+		{
+			name:   "single event",
+			stream: "data: hello\n\n",
+			want:   []SSEEvent{{Data: "hello"}},
+		},
+		{
+			name:   "multi-line data",
+			stream: "data: a\ndata: b\n\ndata: c\n\n",
+			want:   []SSEEvent{{Data: "a\nb"}, {Data: "c"}},
+		},
+		{
+			name:   "CRLF line endings",
+			stream: "data: a\r\n\r\ndata: b\r\n\r\n",
+			want:   []SSEEvent{{Data: "a"}, {Data: "b"}},
+		},
+		{
+			name:   "comments and events without data are ignored",
+			stream: ": ping\n\nevent: noop\n\ndata: a\n\n",
+			want:   []SSEEvent{{Data: "a"}},
+		},
+		{
+			name:   "event field",
+			stream: "event: error\ndata: {}\n\ndata: next\n\n",
+			want:   []SSEEvent{{Event: "error", Data: "{}"}, {Data: "next"}},
+		},
+		{
+			name:   "id is kept for later events",
+			stream: "id: 1\ndata: a\n\ndata: b\n\nid: 2\ndata: c\n\n",
+			want:   []SSEEvent{{ID: "1", Data: "a"}, {ID: "1", Data: "b"}, {ID: "2", Data: "c"}},
+		},
+		{
+			name:   "value without space after colon",
+			stream: "data:a\n\n",
+			want:   []SSEEvent{{Data: "a"}},
+		},
+		{
+			name:   "last event without trailing blank line",
+			stream: "data: a\n\ndata: b",
+			want:   []SSEEvent{{Data: "a"}, {Data: "b"}},
+		},
+		{
+			name:   "line longer than the read buffer",
+			stream: "data: " + long + "\n\n",
+			want:   []SSEEvent{{Data: long}},
+		},
+		{
+			name:    "event within the limit",
+			stream:  "data: 12345\n\n",
+			maxSize: 16,
+			want:    []SSEEvent{{Data: "12345"}},
+		},
+		{
+			name:    "single line over the limit",
+			stream:  "data: a\n\ndata: " + long + "\n\n",
+			maxSize: 1024,
+			want:    []SSEEvent{{Data: "a"}},
+			wantErr: errSSEEventTooLarge,
+		},
+		{
+			name:    "multi-line event over the limit",
+			stream:  strings.Repeat("data: 0123456789\n", 10) + "\n",
+			maxSize: 64,
+			wantErr: errSSEEventTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		// 同一输入分别整体读取和逐字节读取，验证跨 Read 拆分的事件
+		readers := map[string]func() io.Reader{
+			"whole":    func() io.Reader { return strings.NewReader(tt.stream) },
+			"one-byte": func() io.Reader { return iotest.OneByteReader(strings.NewReader(tt.stream)) },
+		}
+		for mode, newReader := range readers {
+			t.Run(tt.name+"/"+mode, func(t *testing.T) {
+				reader := newSSEReader(newReader(), tt.maxSize)
+				var got []SSEEvent
+				var err error
+				for {
+					var event SSEEvent
+					if event, err = reader.Next(); err != nil {
+						break
+					}
+					got = append(got, event)
+				}
+				if tt.wantErr != nil {
+					if !errors.Is(err, tt.wantErr) {
+						t.Fatalf("error = %v, want %v", err, tt.wantErr)
+					}
+				} else if err != io.EOF {
+					t.Fatalf("error = %v, want io.EOF", err)
+				}
+				if len(got) != len(tt.want) {
+					t.Fatalf("got %d events, want %d", len(got), len(tt.want))
+				}
+				for i := range got {
+					if got[i] != tt.want[i] {
+						t.Errorf("event %d = %+v, want %+v", i, got[i], tt.want[i])
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"math"
+	"unicode"
+)
+
+// GLM 分词器的近似估算参数
+// GLM-4 系列词表约 15 万，中文平均约 1.6 字/token，英文约 5 字符/token
+const (
+	cjkTokensPerRune    = 0.625
+	letterRunesPerToken = 5.0
+	digitRunesPerToken  = 3.0
+	otherTokensPerRune  = 0.5
+	messageTokenCost    = 4    // 每条消息的角色与分隔符开销
+	replyPrimingTokens  = 3    // assistant 回复前缀
+	imageTokenCost      = 1024 // 每张图片的估算开销
+)
+
+// TokenCounter 累加多段文本的估算 token 数
+type TokenCounter struct {
+	total float64
+}
+
+func (c *TokenCounter) Add(text string) {
+	c.total += estimateTokenWeight(text)
+}
+
+func (c *TokenCounter) Count() int {
+	return int(math.Ceil(c.total))
+}
+
+// EstimateTokens 估算文本在 GLM 分词器下的 token 数
+func EstimateTokens(text string) int {
+	return int(math.Ceil(estimateTokenWeight(text)))
+}
+
+func estimateTokenWeight(text string) float64 {
+	total := 0.0
+	letterRun := 0
+	digitRun := 0
+
+	flushRuns := func() {
+		if letterRun > 0 {
+			total += math.Ceil(float64(letterRun) / letterRunesPerToken)
+			letterRun = 0
+		}
+		if digitRun > 0 {
+			total += math.Ceil(float64(digitRun) / digitRunesPerToken)
+			digitRun = 0
+		}
+	}
+
+	for _, r := range text {
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || r == '_'):
+			if digitRun > 0 {
+				flushRuns()
+			}
+			letterRun++
+		case r < unicode.MaxASCII && unicode.IsDigit(r):
+			if letterRun > 0 {
+				flushRuns()
+			}
+			digitRun++
+		case unicode.IsSpace(r):
+			// 空白通常并入下一个词
+			flushRuns()
+		case isCJK(r):
+			flushRuns()
+			total += cjkTokensPerRune
+		case r < unicode.MaxASCII:
+			// 标点符号
+			flushRuns()
+			total++
+		default:
+			flushRuns()
+			total += otherTokensPerRune
+		}
+	}
+	flushRuns()
+
+	return total
+}
+
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) ||
+		unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) ||
+		unicode.Is(unicode.Hangul, r) ||
+		(r >= 0x3000 && r <= 0x303F) || // CJK 标点
+		(r >= 0xFF00 && r <= 0xFFEF) // 全角字符
+}
+
+// EstimateMessagesTokens 估算发送到上游的消息列表的 prompt token 数
+func EstimateMessagesTokens(messages []Message) int {
+	total := replyPrimingTokens
+	for _, msg := range messages {
+		text, imageURLs := msg.ParseContent()
+		total += messageTokenCost + EstimateTokens(msg.Role) + EstimateTokens(text)
+		total += len(imageURLs) * imageTokenCost
+	}
+	return total
+}
+
+// 构建 OpenAI 格式的 usage
+func newUsage(promptTokens, completionTokens, reasoningTokens int) *Usage {
+	return &Usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+		CompletionTokensDetails: &CompletionTokensDetails{
+			ReasoningTokens: reasoningTokens,
+		},
+	}
+}
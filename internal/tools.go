@@ -0,0 +1,342 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// OpenAI 格式的工具定义
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// OpenAI 格式的工具调用，流式响应中 Index 必填
+type ToolCall struct {
+	Index    *int             `json:"index,omitempty"`
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+const (
+	toolCallOpenTag  = "<tool_call>"
+	toolCallCloseTag = "</tool_call>"
+)
+
+// 解析 tool_choice，返回是否启用工具以及强制调用的工具名
+// 支持 "auto" / "none" / "required" 以及 {"type":"function","function":{"name":...}}
+func parseToolChoice(toolChoice interface{}) (enabled bool, required bool, forcedName string) {
+	switch choice := toolChoice.(type) {
+	case nil:
+		return true, false, ""
+	case string:
+		switch choice {
+		case "none":
+			return false, false, ""
+		case "required", "any":
+			return true, true, ""
+		}
+		return true, false, ""
+	case map[string]interface{}:
+		if fn, ok := choice["function"].(map[string]interface{}); ok {
+			if name, ok := fn["name"].(string); ok && name != "" {
+				return true, true, name
+			}
+		}
+		// Claude 格式: {"type":"tool","name":...} / {"type":"any"} / {"type":"none"}
+		choiceType, _ := choice["type"].(string)
+		if name, ok := choice["name"].(string); ok && name != "" && choiceType == "tool" {
+			return true, true, name
+		}
+		switch choiceType {
+		case "none":
+			return false, false, ""
+		case "any", "required":
+			return true, true, ""
+		}
+	}
+	return true, false, ""
+}
+
+// validateToolChoice 检查强制调用的工具是否在 tools 中
+func validateToolChoice(tools []Tool, toolChoice interface{}) error {
+	_, _, forcedName := parseToolChoice(toolChoice)
+	if forcedName == "" {
+		return nil
+	}
+	for _, t := range tools {
+		if t.Function.Name == forcedName {
+			return nil
+		}
+	}
+	return fmt.Errorf("tool_choice refers to tool %q, which is not in tools", forcedName)
+}
+
+// 构建注入到 system 中的工具说明
+func buildToolPrompt(tools []Tool, required bool, forcedName string) string {
+	var sb strings.Builder
+	sb.WriteString("You have access to the following tools. ")
+	sb.WriteString("To call a tool, reply with one or more blocks in exactly this format and nothing else after them:\n\n")
+	sb.WriteString(toolCallOpenTag + "\n")
+	sb.WriteString(`{"name": "<tool name>", "arguments": {<JSON arguments matching the tool parameters>}}`)
+	sb.WriteString("\n" + toolCallCloseTag + "\n\n")
+	sb.WriteString("Tool results will be returned to you inside <tool_result> blocks. ")
+	sb.WriteString("Only call tools listed below, and never invent tool results yourself.\n\n")
+	sb.WriteString("Available tools:\n")
+	for _, t := range tools {
+		if t.Function.Name == "" {
+			continue
+		}
+		sb.WriteString("- name: " + t.Function.Name + "\n")
+		if t.Function.Description != "" {
+			sb.WriteString("  description: " + t.Function.Description + "\n")
+		}
+		if len(t.Function.Parameters) > 0 {
+			sb.WriteString("  parameters: " + compactJSON(t.Function.Parameters) + "\n")
+		}
+	}
+	if forcedName != "" {
+		sb.WriteString(fmt.Sprintf("\nYou MUST call the tool %q in this reply.\n", forcedName))
+	} else if required {
+		sb.WriteString("\nYou MUST call at least one tool in this reply.\n")
+	} else {
+		sb.WriteString("\nIf no tool is needed, answer the user directly without any tool_call block.\n")
+	}
+	return sb.String()
+}
+
+func compactJSON(raw json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return string(raw)
+	}
+	return buf.String()
+}
+
+func formatToolCallBlock(name, arguments string) string {
+	args := strings.TrimSpace(arguments)
+	if args == "" || !json.Valid([]byte(args)) {
+		argsJSON, _ := json.Marshal(args)
+		args = string(argsJSON)
+	}
+	return fmt.Sprintf("%s\n{\"name\": %q, \"arguments\": %s}\n%s", toolCallOpenTag, name, args, toolCallCloseTag)
+}
+
+// applyToolEmulation 将工具定义和工具调用历史转换为上游可理解的纯文本消息
+// 上游只支持 system / user / assistant 三种角色
+func applyToolEmulation(messages []Message, tools []Tool, toolChoice interface{}) []Message {
+	enabled, required, forcedName := parseToolChoice(toolChoice)
+
+	toolNames := make(map[string]string)
+	lastToolResult := -1
+	var converted []Message
+	for _, msg := range messages {
+		switch {
+		case msg.Role == "assistant" && len(msg.ToolCalls) > 0:
+			text, _ := msg.ParseContent()
+			var parts []string
+			if strings.TrimSpace(text) != "" {
+				parts = append(parts, text)
+			}
+			for _, tc := range msg.ToolCalls {
+				toolNames[tc.ID] = tc.Function.Name
+				parts = append(parts, formatToolCallBlock(tc.Function.Name, tc.Function.Arguments))
+			}
+			converted = append(converted, Message{Role: "assistant", Content: strings.Join(parts, "\n")})
+		case msg.Role == "tool" || msg.Role == "function":
+			text, _ := msg.ParseContent()
+			name := msg.Name
+			if name == "" {
+				name = toolNames[msg.ToolCallID]
+			}
+			block := fmt.Sprintf("<tool_result tool_call_id=%q name=%q>\n%s\n</tool_result>", msg.ToolCallID, name, text)
+			// 连续的工具结果合并为一条 user 消息
+			if n := len(converted); n > 0 && lastToolResult == n-1 {
+				prev, _ := converted[n-1].ParseContent()
+				converted[n-1].Content = prev + "\n" + block
+				continue
+			}
+			converted = append(converted, Message{Role: "user", Content: block})
+			lastToolResult = len(converted) - 1
+		default:
+			converted = append(converted, msg)
+		}
+	}
+
+	if !enabled || len(tools) == 0 {
+		return converted
+	}
+
+	toolPrompt := buildToolPrompt(tools, required, forcedName)
+	if len(converted) > 0 && converted[0].Role == "system" {
+		text, _ := converted[0].ParseContent()
+		converted[0] = Message{Role: "system", Content: text + "\n\n" + toolPrompt}
+		return converted
+	}
+	return append([]Message{{Role: "system", Content: toolPrompt}}, converted...)
+}
+
+func hasToolMessages(messages []Message) bool {
+	for _, msg := range messages {
+		if msg.Role == "tool" || msg.Role == "function" || len(msg.ToolCalls) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func newToolCallID() string {
+	return "call_" + strings.ReplaceAll(uuid.New().String(), "-", "")[:24]
+}
+
+// 解析模型输出的单个 tool_call 块
+func parseToolCallBlock(inner string) (ToolCall, bool) {
+	inner = strings.TrimSpace(inner)
+	inner = strings.TrimPrefix(inner, "```json")
+	inner = strings.TrimPrefix(inner, "```")
+	inner = strings.TrimSuffix(inner, "```")
+	inner = strings.TrimSpace(inner)
+
+	var raw struct {
+		Name       string          `json:"name"`
+		Arguments  json.RawMessage `json:"arguments"`
+		Parameters json.RawMessage `json:"parameters"`
+	}
+	if err := json.Unmarshal([]byte(inner), &raw); err != nil || raw.Name == "" {
+		return ToolCall{}, false
+	}
+
+	args := raw.Arguments
+	if len(args) == 0 {
+		args = raw.Parameters
+	}
+	arguments := "{}"
+	if len(args) > 0 {
+		var s string
+		if err := json.Unmarshal(args, &s); err == nil {
+			arguments = s
+		} else {
+			arguments = compactJSON(args)
+		}
+	}
+
+	return ToolCall{
+		ID:   newToolCallID(),
+		Type: "function",
+		Function: ToolCallFunction{
+			Name:      raw.Name,
+			Arguments: arguments,
+		},
+	}, true
+}
+
+// ToolCallFilter 从上游回答中流式提取 <tool_call> 块
+type ToolCallFilter struct {
+	buffer    string
+	inCall    bool
+	callCount int
+}
+
+func (f *ToolCallFilter) HasCalls() bool {
+	return f.callCount > 0
+}
+
+// Process 返回可直接输出的文本以及本次解析出的完整工具调用
+func (f *ToolCallFilter) Process(content string) (string, []ToolCall) {
+	content = f.buffer + content
+	f.buffer = ""
+
+	var text strings.Builder
+	var calls []ToolCall
+	for content != "" {
+		if f.inCall {
+			idx := strings.Index(content, toolCallCloseTag)
+			if idx == -1 {
+				f.buffer = content
+				break
+			}
+			calls = append(calls, f.finishCall(content[:idx], &text)...)
+			content = content[idx+len(toolCallCloseTag):]
+			f.inCall = false
+			continue
+		}
+
+		idx := strings.Index(content, toolCallOpenTag)
+		if idx == -1 {
+			keep := partialSuffixLen(content, toolCallOpenTag)
+			text.WriteString(content[:len(content)-keep])
+			f.buffer = content[len(content)-keep:]
+			break
+		}
+		text.WriteString(content[:idx])
+		content = content[idx+len(toolCallOpenTag):]
+		f.inCall = true
+	}
+
+	return f.trimAfterCalls(text.String()), calls
+}
+
+// Flush 处理未闭合的 tool_call 块（模型可能省略结束标签）
+func (f *ToolCallFilter) Flush() (string, []ToolCall) {
+	content := f.buffer
+	f.buffer = ""
+	if !f.inCall {
+		return f.trimAfterCalls(content), nil
+	}
+	f.inCall = false
+
+	var text strings.Builder
+	calls := f.finishCall(content, &text)
+	return f.trimAfterCalls(text.String()), calls
+}
+
+func (f *ToolCallFilter) finishCall(inner string, text *strings.Builder) []ToolCall {
+	call, ok := parseToolCallBlock(inner)
+	if !ok {
+		LogWarn("[Tools] Failed to parse tool call: %s", inner[:min(200, len(inner))])
+		text.WriteString(toolCallOpenTag + inner)
+		return nil
+	}
+	index := f.callCount
+	call.Index = &index
+	f.callCount++
+	return []ToolCall{call}
+}
+
+// 工具调用之后的空白文本不再输出
+func (f *ToolCallFilter) trimAfterCalls(text string) string {
+	if f.callCount > 0 && strings.TrimSpace(text) == "" {
+		return ""
+	}
+	return text
+}
+
+// 返回 s 末尾与 tag 前缀匹配的最长长度
+func partialSuffixLen(s, tag string) int {
+	maxLen := len(tag) - 1
+	if len(s) < maxLen {
+		maxLen = len(s)
+	}
+	for i := maxLen; i > 0; i-- {
+		if strings.HasSuffix(s, tag[:i]) {
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestToolCallFilter(t *testing.T) {
+	tests := []struct {
+		name      string
+		chunks    []string
+		wantText  string
+		wantCalls []string // name + " " + arguments
+	}{
+		{
+			name:     "plain text",
+			chunks:   []string{"Hello ", "world"},
+			wantText: "Hello world",
+		},
+		{
+			name:      "single call",
+			chunks:    []string{"<tool_call>\n{\"name\": \"get_weather\", \"arguments\": {\"city\": \"Paris\"}}\n</tool_call>"},
+			wantCalls: []string{`get_weather {"city":"Paris"}`},
+		},
+		{
+			name:      "open tag split across chunks",
+			chunks:    []string{"Let me check.<to", "ol_c", "all>{\"name\":\"f\",\"arguments\":{}}</tool_call>"},
+			wantText:  "Let me check.",
+			wantCalls: []string{"f {}"},
+		},
+		{
+			name:      "close tag split across chunks",
+			chunks:    []string{"<tool_call>{\"name\":\"f\",", "\"arguments\":{\"a\":1}}</tool", "_call>"},
+			wantCalls: []string{`f {"a":1}`},
+		},
+		{
+			name:      "missing close tag is flushed",
+			chunks:    []string{"<tool_call>{\"name\":\"f\",\"arguments\":\"{\\\"x\\\":2}\"}"},
+			wantCalls: []string{`f {"x":2}`},
+		},
+		{
+			name:   "two calls with whitespace between",
+			chunks: []string{"<tool_call>{\"name\":\"a\"}</tool_call>\n", "<tool_call>{\"name\":\"b\",\"parameters\":{\"k\":\"v\"}}</tool_call>\n"},
+			wantCalls: []string{
+				"a {}",
+				`b {"k":"v"}`,
+			},
+		},
+		{
+			name:      "fenced JSON inside the block",
+			chunks:    []string{"<tool_call>\n```json\n{\"name\":\"f\",\"arguments\":{}}\n```\n</tool_call>"},
+			wantCalls: []string{"f {}"},
+		},
+		{
+			name:     "invalid block is returned as text",
+			chunks:   []string{"<tool_call>not json</tool_call>"},
+			wantText: "<tool_call>not json",
+		},
+		{
+			name:     "partial open tag at end is flushed as text",
+			chunks:   []string{"a <tool"},
+			wantText: "a <tool",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := &ToolCallFilter{}
+			var text strings.Builder
+			var calls []ToolCall
+			for _, chunk := range tt.chunks {
+				out, got := filter.Process(chunk)
+				text.WriteString(out)
+				calls = append(calls, got...)
+			}
+			rest, more := filter.Flush()
+			text.WriteString(rest)
+			calls = append(calls, more...)
+
+			if text.String() != tt.wantText {
+				t.Errorf("text = %q, want %q", text.String(), tt.wantText)
+			}
+			if len(calls) != len(tt.wantCalls) {
+				t.Fatalf("got %d calls, want %d", len(calls), len(tt.wantCalls))
+			}
+			for i, call := range calls {
+				if got := call.Function.Name + " " + call.Function.Arguments; got != tt.wantCalls[i] {
+					t.Errorf("call %d = %q, want %q", i, got, tt.wantCalls[i])
+				}
+				if call.Index == nil || *call.Index != i {
+					t.Errorf("call %d has index %v", i, call.Index)
+				}
+				if !strings.HasPrefix(call.ID, "call_") {
+					t.Errorf("call %d has id %q", i, call.ID)
+				}
+			}
+			if filter.HasCalls() != (len(tt.wantCalls) > 0) {
+				t.Errorf("HasCalls = %v", filter.HasCalls())
+			}
+		})
+	}
+}
+
+func TestValidateToolChoice(t *testing.T) {
+	tools := []Tool{{Type: "function", Function: ToolFunction{Name: "get_weather"}}}
+	tests := []struct {
+		name    string
+		choice  interface{}
+		wantErr bool
+	}{
+		{"unset", nil, false},
+		{"auto", "auto", false},
+		{"required", "required", false},
+		{"forced known tool", map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": "get_weather"}}, false},
+		{"forced unknown tool", map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": "search"}}, true},
+		{"claude forced unknown tool", map[string]interface{}{"type": "tool", "name": "search"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateToolChoice(tools, tt.choice); (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -41,9 +42,74 @@ type UpstreamFile struct {
 	Media  string             `json:"media"`
 }
 
-// UploadImageFromURL 从 URL 或 base64 上传图片到 z.ai
-func UploadImageFromURL(token string, imageURL string) (*UpstreamFile, error) {
-	var imageData []byte
+// imageData 是下载或解码后的图片
+type imageData struct {
+	data     []byte
+	filename string
+}
+
+// imageUploads 缓存一次客户端请求中的图片，重试、换用后备模型和结构化输出重试时不再重复下载和上传。
+// 文件属于上传时使用的账号，换用账号后只重新上传，不重新下载
+type imageUploads struct {
+	images map[string]*imageData
+	// token -> 图片 URL -> 上传后的文件
+	files map[string]map[string]*UpstreamFile
+	// 下载或解码失败的图片不再重试
+	failed map[string]bool
+}
+
+func newImageUploads() *imageUploads {
+	return &imageUploads{
+		images: make(map[string]*imageData),
+		files:  make(map[string]map[string]*UpstreamFile),
+		failed: make(map[string]bool),
+	}
+}
+
+// Upload 返回与 imageURLs 一一对应的上传文件，失败的图片为 nil
+func (u *imageUploads) Upload(ctx context.Context, token string, imageURLs []string) []*UpstreamFile {
+	uploaded := u.files[token]
+	if uploaded == nil {
+		uploaded = make(map[string]*UpstreamFile)
+		u.files[token] = uploaded
+	}
+
+	files := make([]*UpstreamFile, len(imageURLs))
+	for i, url := range imageURLs {
+		if file, ok := uploaded[url]; ok {
+			files[i] = file
+			continue
+		}
+		if u.failed[url] {
+			continue
+		}
+		file, err := u.upload(ctx, token, url)
+		if err != nil {
+			LogError("Failed to upload image %s: %v", url[:min(50, len(url))], err)
+			continue
+		}
+		uploaded[url] = file
+		files[i] = file
+	}
+	return files
+}
+
+func (u *imageUploads) upload(ctx context.Context, token, url string) (*UpstreamFile, error) {
+	image, ok := u.images[url]
+	if !ok {
+		var err error
+		if image, err = loadImage(ctx, url); err != nil {
+			u.failed[url] = true
+			return nil, err
+		}
+		u.images[url] = image
+	}
+	return uploadImage(ctx, token, image)
+}
+
+// loadImage 下载 URL 或解码 base64 得到图片内容
+func loadImage(ctx context.Context, imageURL string) (*imageData, error) {
+	var data []byte
 	var filename string
 	var contentType string
 
@@ -69,7 +135,7 @@ func UploadImageFromURL(token string, imageURL string) (*UpstreamFile, error) {
 
 		// 解码 base64
 		var err error
-		imageData, err = base64.StdEncoding.DecodeString(parts[1])
+		data, err = base64.StdEncoding.DecodeString(parts[1])
 		if err != nil {
 			return nil, fmt.Errorf("failed to decode base64: %v", err)
 		}
@@ -86,7 +152,11 @@ func UploadImageFromURL(token string, imageURL string) (*UpstreamFile, error) {
 		filename = uuid.New().String()[:12] + ext
 	} else {
 		// 从 URL 下载图片
-		resp, err := http.Get(imageURL)
+		req, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image url: %v", err)
+		}
+		resp, err := clientFor(ctx).Do(req)
 		if err != nil {
 			return nil, fmt.Errorf("failed to download image: %v", err)
 		}
@@ -96,7 +166,7 @@ func UploadImageFromURL(token string, imageURL string) (*UpstreamFile, error) {
 			return nil, fmt.Errorf("failed to download image: status %d", resp.StatusCode)
 		}
 
-		imageData, err = io.ReadAll(resp.Body)
+		data, err = io.ReadAll(resp.Body)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read image data: %v", err)
 		}
@@ -117,34 +187,38 @@ func UploadImageFromURL(token string, imageURL string) (*UpstreamFile, error) {
 		}
 	}
 
+	return &imageData{data: data, filename: filename}, nil
+}
+
+// uploadImage 将图片上传到 z.ai，上传的文件只能由该 token 对应的账号使用
+func uploadImage(ctx context.Context, token string, image *imageData) (*UpstreamFile, error) {
 	// 构建 multipart form 请求
 	var buf bytes.Buffer
 	writer := multipart.NewWriter(&buf)
 
-	part, err := writer.CreateFormFile("file", filename)
+	part, err := writer.CreateFormFile("file", image.filename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create form file: %v", err)
 	}
 
-	if _, err := part.Write(imageData); err != nil {
+	if _, err := part.Write(image.data); err != nil {
 		return nil, fmt.Errorf("failed to write image data: %v", err)
 	}
 
 	writer.Close()
 
 	// 发送上传请求
-	req, err := http.NewRequest("POST", "https://chat.z.ai/api/v1/files/", &buf)
+	req, err := http.NewRequestWithContext(ctx, "POST", upstreamURL("/api/v1/files/"), &buf)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create upload request: %v", err)
 	}
 
 	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("Content-Type", writer.FormDataContentType())
-	req.Header.Set("Origin", "https://chat.z.ai")
-	req.Header.Set("Referer", "https://chat.z.ai/")
+	req.Header.Set("Origin", Cfg.UpstreamBaseURL)
+	req.Header.Set("Referer", upstreamURL("/"))
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := clientFor(ctx).Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to upload image: %v", err)
 	}
@@ -175,20 +249,6 @@ func UploadImageFromURL(token string, imageURL string) (*UpstreamFile, error) {
 	}, nil
 }
 
-// UploadImages 批量上传图片
-func UploadImages(token string, imageURLs []string) ([]*UpstreamFile, error) {
-	var files []*UpstreamFile
-	for _, url := range imageURLs {
-		file, err := UploadImageFromURL(token, url)
-		if err != nil {
-			LogError("Failed to upload image %s: %v", url[:min(50, len(url))], err)
-			continue
-		}
-		files = append(files, file)
-	}
-	return files, nil
-}
-
 func min(a, b int) int {
 	if a < b {
 		return a
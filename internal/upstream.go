@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// upstreamClient 是访问 z.ai 的共享 HTTP 客户端，所有上游请求复用同一个连接池
+var upstreamClient = &http.Client{}
+
+var (
+	// 按出口代理缓存的客户端，用于账号级代理
+	proxyClients   = make(map[string]*http.Client)
+	proxyClientsMu sync.Mutex
+	upstreamTLS    *tls.Config
+)
+
+var errUpstreamTimeout = errors.New("upstream timed out")
+
+type upstreamProxyKey struct{}
+
+// InitUpstreamClient 按配置创建共享的上游 Transport
+func InitUpstreamClient() {
+	if Cfg.UpstreamCAFile != "" {
+		pool, err := loadCABundle(Cfg.UpstreamCAFile)
+		if err != nil {
+			LogError("Failed to load CA bundle: %v", err)
+		} else {
+			upstreamTLS = &tls.Config{RootCAs: pool}
+			LogInfo("Loaded CA bundle from %s", Cfg.UpstreamCAFile)
+		}
+	}
+
+	transport := newUpstreamTransport()
+	if Cfg.UpstreamProxy != "" {
+		proxyURL, err := parseProxyURL(Cfg.UpstreamProxy)
+		if err != nil {
+			LogError("Invalid UPSTREAM_PROXY: %v", err)
+		} else {
+			transport.Proxy = http.ProxyURL(proxyURL)
+			LogInfo("Using upstream proxy %s", proxyURL.Redacted())
+		}
+	}
+	upstreamClient = &http.Client{Transport: transport}
+
+	proxyClientsMu.Lock()
+	proxyClients = make(map[string]*http.Client)
+	proxyClientsMu.Unlock()
+}
+
+// newUpstreamTransport 创建带连接池和超时设置的 Transport，未设置代理时沿用 HTTPS_PROXY 等环境变量
+func newUpstreamTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   Cfg.UpstreamConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = Cfg.UpstreamConnectTimeout
+	transport.ResponseHeaderTimeout = Cfg.UpstreamFirstByteTimeout
+	transport.MaxIdleConns = Cfg.UpstreamMaxIdleConns
+	transport.MaxIdleConnsPerHost = Cfg.UpstreamMaxIdleConnsPerHost
+	transport.MaxConnsPerHost = Cfg.UpstreamMaxConnsPerHost
+	transport.IdleConnTimeout = Cfg.UpstreamIdleConnTimeout
+	transport.ForceAttemptHTTP2 = true
+	if upstreamTLS != nil {
+		transport.TLSClientConfig = upstreamTLS.Clone()
+	}
+	return transport
+}
+
+// 支持 http、https 和 socks5 代理
+func parseProxyURL(raw string) (*url.URL, error) {
+	proxyURL, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return proxyURL, nil
+	}
+	return nil, errors.New("unsupported proxy scheme " + proxyURL.Scheme)
+}
+
+// loadCABundle 将 PEM 证书追加到系统根证书中
+func loadCABundle(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates found in " + path)
+	}
+	return pool, nil
+}
+
+// withUpstreamProxy 为本次请求指定出口代理，空字符串表示使用全局设置
+func withUpstreamProxy(ctx context.Context, proxy string) context.Context {
+	if proxy == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, upstreamProxyKey{}, proxy)
+}
+
+// clientFor 返回 ctx 指定代理对应的客户端，同一代理复用同一个 Transport
+func clientFor(ctx context.Context) *http.Client {
+	proxy, _ := ctx.Value(upstreamProxyKey{}).(string)
+	if proxy == "" {
+		return upstreamClient
+	}
+
+	proxyClientsMu.Lock()
+	defer proxyClientsMu.Unlock()
+	if client, ok := proxyClients[proxy]; ok {
+		return client
+	}
+	proxyURL, err := parseProxyURL(proxy)
+	if err != nil {
+		LogError("Invalid token proxy, using default client: %v", err)
+		return upstreamClient
+	}
+	transport := newUpstreamTransport()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	client := &http.Client{Transport: transport}
+	proxyClients[proxy] = client
+	return client
+}
+
+// doUpstream 发送上游请求，返回的响应体在首字节或两次读取之间超时后取消请求，
+// 此时 Read 返回 errUpstreamTimeout；ctx 取消（客户端断开）时同样中止上游连接
+func doUpstream(ctx context.Context, req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	resp, err := clientFor(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		if isTimeoutError(err) {
+			return nil, errUpstreamTimeout
+		}
+		return nil, err
+	}
+	resp.Body = newTimeoutBody(resp.Body, cancel, Cfg.UpstreamFirstByteTimeout, Cfg.UpstreamIdleTimeout)
+	return resp, nil
+}
+
+func isTimeoutError(err error) bool {
+	if errors.Is(err, errUpstreamTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isClientGone 判断错误是否由客户端断开导致
+func isClientGone(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || errors.Is(err, context.Canceled)
+}
+
+// timeoutBody 在读取间隔超过限制时取消上游请求
+type timeoutBody struct {
+	body     io.ReadCloser
+	cancel   context.CancelFunc
+	idle     time.Duration
+	timer    *time.Timer
+	mu       sync.Mutex
+	timedOut bool
+}
+
+func newTimeoutBody(body io.ReadCloser, cancel context.CancelFunc, firstByte, idle time.Duration) *timeoutBody {
+	b := &timeoutBody{body: body, cancel: cancel, idle: idle}
+	if firstByte > 0 {
+		b.timer = time.AfterFunc(firstByte, b.expire)
+	}
+	return b
+}
+
+func (b *timeoutBody) expire() {
+	b.mu.Lock()
+	b.timedOut = true
+	b.mu.Unlock()
+	b.cancel()
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.mu.Lock()
+	timedOut := b.timedOut
+	b.mu.Unlock()
+	if timedOut {
+		return n, errUpstreamTimeout
+	}
+	if n > 0 {
+		if b.idle <= 0 {
+			b.stopTimer()
+		} else if b.timer == nil {
+			b.timer = time.AfterFunc(b.idle, b.expire)
+		} else {
+			b.timer.Reset(b.idle)
+		}
+	}
+	return n, err
+}
+
+func (b *timeoutBody) stopTimer() {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+}
+
+func (b *timeoutBody) Close() error {
+	b.stopTimer()
+	b.cancel()
+	return b.body.Close()
+}
@@ -1,55 +1,233 @@
 package internal
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 )
 
-var (
-	feVersion   string
-	versionLock sync.RWMutex
+var feVersionPattern = regexp.MustCompile(`prod-fe-[\.\d]+`)
+
+const (
+	// 签名或版本不匹配触发的重新抓取之间的最短间隔，连续触发时翻倍
+	feVersionMinBackoff = 10 * time.Second
+	feVersionMaxBackoff = 10 * time.Minute
 )
 
+// feVersionTracker 维护请求头 X-FE-Version 使用的前端版本号
+type feVersionTracker struct {
+	mu          sync.RWMutex
+	version     string
+	source      string // override / file / scraped
+	lastSuccess time.Time
+	lastAttempt time.Time
+	lastError   string
+	refreshing  bool
+	backoff     time.Duration
+	nextAllowed time.Time
+}
+
+var feVersions = &feVersionTracker{}
+
 func GetFeVersion() string {
-	versionLock.RLock()
-	defer versionLock.RUnlock()
-	return feVersion
+	feVersions.mu.RLock()
+	defer feVersions.mu.RUnlock()
+	return feVersions.version
 }
 
-func fetchFeVersion() {
-	resp, err := http.Get("https://chat.z.ai/")
+func fetchFeVersion(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", upstreamURL("/"), nil)
 	if err != nil {
-		LogError("Failed to fetch fe version: %v", err)
-		return
+		return "", err
+	}
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return "", err
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		LogError("Failed to read fe version response: %v", err)
+		return "", fmt.Errorf("failed to read response: %v", err)
+	}
+	match := feVersionPattern.FindString(string(body))
+	if match == "" {
+		return "", fmt.Errorf("no prod-fe version found in homepage (status %d)", resp.StatusCode)
+	}
+	return match, nil
+}
+
+// refresh 抓取首页中的版本号，成功后写入 FE_VERSION_FILE
+func (t *feVersionTracker) refresh(reason string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	version, err := fetchFeVersion(ctx)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refreshing = false
+	t.lastAttempt = time.Now()
+	if err != nil {
+		t.lastError = err.Error()
+		LogError("Failed to fetch fe version (%s): %v", reason, err)
+		return
+	}
+
+	t.lastError = ""
+	t.lastSuccess = t.lastAttempt
+	t.source = "scraped"
+	if version == t.version {
+		LogDebug("Fe version unchanged: %s", version)
+		return
+	}
+	LogInfo("Updated fe version: %s -> %s (%s)", t.version, version, reason)
+	t.version = version
+	// 版本确实变化时重置退避
+	t.backoff = 0
+	if Cfg.FeVersionFile != "" {
+		if err := os.WriteFile(Cfg.FeVersionFile, []byte(version+"\n"), 0644); err != nil {
+			LogError("Failed to save fe version: %v", err)
+		}
+	}
+}
+
+// RequestRefresh 在上游疑似因版本或签名不匹配拒绝请求时立即重新抓取，按指数退避限制频率
+func (t *feVersionTracker) RequestRefresh(reason string) {
+	t.mu.Lock()
+	now := time.Now()
+	if t.source == "override" || t.refreshing || now.Before(t.nextAllowed) {
+		t.mu.Unlock()
+		return
+	}
+	t.backoff *= 2
+	if t.backoff < feVersionMinBackoff {
+		t.backoff = feVersionMinBackoff
+	} else if t.backoff > feVersionMaxBackoff {
+		t.backoff = feVersionMaxBackoff
+	}
+	t.nextAllowed = now.Add(t.backoff)
+	t.refreshing = true
+	t.mu.Unlock()
+
+	LogWarn("Refreshing fe version: %s", reason)
+	go t.refresh(reason)
+}
+
+// loadFile 启动时读取上次保存的版本号，避免首次抓取失败时请求头为空
+func (t *feVersionTracker) loadFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			LogError("Failed to read fe version file: %v", err)
+		}
+		return
+	}
+	version := feVersionPattern.FindString(string(data))
+	if version == "" {
+		LogWarn("No fe version found in %s", path)
+		return
+	}
+	t.mu.Lock()
+	t.version, t.source = version, "file"
+	t.mu.Unlock()
+	LogInfo("Loaded fe version %s from %s", version, path)
+}
+
+// checkVersionMismatch 检查非 200 响应是否像是前端版本或签名失效，是则触发重新抓取。
+// 会预读响应体开头，读取的内容仍可从 resp.Body 读到
+func checkVersionMismatch(resp *http.Response) {
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusUpgradeRequired:
+	default:
 		return
 	}
+	head, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body = &peekedBody{Reader: io.MultiReader(bytes.NewReader(head), resp.Body), body: resp.Body}
 
-	re := regexp.MustCompile(`prod-fe-[\.\d]+`)
-	match := re.FindString(string(body))
-	if match != "" {
-		versionLock.Lock()
-		feVersion = match
-		versionLock.Unlock()
-		LogInfo("Updated fe version: %s", match)
+	text := strings.ToLower(string(head))
+	if resp.StatusCode == http.StatusUpgradeRequired || strings.Contains(text, "version") || strings.Contains(text, "signature") {
+		feVersions.RequestRefresh(fmt.Sprintf("upstream status %d", resp.StatusCode))
 	}
 }
 
+// StartVersionUpdater 设置了 FE_VERSION 时固定使用该版本，否则先读取 FE_VERSION_FILE，再定期抓取首页
 func StartVersionUpdater() {
-	fetchFeVersion()
+	if Cfg.FeVersion != "" {
+		feVersions.mu.Lock()
+		feVersions.version, feVersions.source = Cfg.FeVersion, "override"
+		feVersions.mu.Unlock()
+		LogInfo("Using fe version override: %s", Cfg.FeVersion)
+		return
+	}
+	if Cfg.FeVersionFile != "" {
+		feVersions.loadFile(Cfg.FeVersionFile)
+	}
 
-	ticker := time.NewTicker(1 * time.Hour)
+	feVersions.refresh("startup")
+	if Cfg.FeVersionRefreshInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(Cfg.FeVersionRefreshInterval)
 	go func() {
 		for range ticker.C {
-			fetchFeVersion()
+			feVersions.refresh("scheduled")
 		}
 	}()
 }
+
+// feVersionStatus 是 /admin/version 返回的状态
+type feVersionStatus struct {
+	Version     string     `json:"fe_version"`
+	Source      string     `json:"source,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	NextRefresh *time.Time `json:"next_forced_refresh,omitempty"`
+}
+
+func (t *feVersionTracker) status() feVersionStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	optionalTime := func(v time.Time) *time.Time {
+		if v.IsZero() {
+			return nil
+		}
+		return &v
+	}
+	return feVersionStatus{
+		Version:     t.version,
+		Source:      t.source,
+		LastSuccess: optionalTime(t.lastSuccess),
+		LastAttempt: optionalTime(t.lastAttempt),
+		LastError:   t.lastError,
+		NextRefresh: optionalTime(t.nextAllowed),
+	}
+}
+
+// HandleAdminVersion 返回当前前端版本号和最近一次抓取的结果，POST 立即重新抓取
+func HandleAdminVersion(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if Cfg.FeVersion != "" {
+			writeAdminError(w, http.StatusConflict, "FE_VERSION override is set")
+			return
+		}
+		feVersions.refresh("manual")
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, feVersions.status())
+}
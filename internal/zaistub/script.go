@@ -0,0 +1,114 @@
+package zaistub
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Event 是脚本中的一条上游 SSE 事件
+type Event struct {
+	Phase        string `json:"phase"`
+	DeltaContent string `json:"delta_content,omitempty"`
+	EditContent  string `json:"edit_content,omitempty"`
+	// 发送本事件前的额外延迟（毫秒）
+	DelayMs int `json:"delay_ms,omitempty"`
+	// 发送错误事件并结束，不再发送 done
+	Error string `json:"error,omitempty"`
+	// 不发送 done 直接结束响应，模拟连接中断
+	Abort bool `json:"abort,omitempty"`
+}
+
+// Script 是一次对话返回的事件序列，末尾会自动追加 done 事件
+type Script []Event
+
+// LoadScripts 从目录加载 <name>.json 脚本，覆盖同名内置脚本
+func LoadScripts(dir string) (map[string]Script, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	scripts := make(map[string]Script)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var script Script
+		if err := json.Unmarshal(data, &script); err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Base(path), err)
+		}
+		scripts[strings.TrimSuffix(filepath.Base(path), ".json")] = script
+	}
+	return scripts, nil
+}
+
+// splitDeltas 将文本按词切成多个 delta，模拟逐字输出
+func splitDeltas(text string) []string {
+	var parts []string
+	var current strings.Builder
+	for _, r := range text {
+		current.WriteRune(r)
+		if r == ' ' || r == '\n' || r > 0x2E80 {
+			parts = append(parts, current.String())
+			current.Reset()
+		}
+	}
+	if current.Len() > 0 {
+		parts = append(parts, current.String())
+	}
+	return parts
+}
+
+func answerEvents(text string) Script {
+	var script Script
+	for _, part := range splitDeltas(text) {
+		script = append(script, Event{Phase: "answer", DeltaContent: part})
+	}
+	return script
+}
+
+// thinkingEvents 按 z.ai 的格式输出思考内容：<details> 开头、每行以 "> " 引用，
+// 进入 answer 阶段时 edit_content 携带完整的思考块
+func thinkingEvents(thinking string) Script {
+	script := Script{{Phase: "thinking", DeltaContent: `<details type="reasoning" done="false">` + "\n> "}}
+	for _, part := range splitDeltas(strings.ReplaceAll(thinking, "\n", "\n> ")) {
+		script = append(script, Event{Phase: "thinking", DeltaContent: part})
+	}
+	quoted := "> " + strings.ReplaceAll(thinking, "\n", "\n> ")
+	script = append(script, Event{
+		Phase:       "answer",
+		EditContent: `<details type="reasoning" done="true" duration="1">` + "\n" + quoted + "\n</details>\n",
+	})
+	return script
+}
+
+// builtinScript 返回内置场景，prompt 为用户最后一条消息
+func builtinScript(name, prompt string) (Script, bool) {
+	reply := fmt.Sprintf("This is a stub reply to: %s", prompt)
+	switch name {
+	case "answer":
+		return answerEvents(reply), true
+	case "thinking":
+		script := thinkingEvents("The user sent a message.\nI should reply briefly.")
+		return append(script, answerEvents(reply)...), true
+	case "search":
+		script := Script{
+			{Phase: "tool_call", EditContent: `<glm_block view="">{"type": "mcp", "data": {"metadata": {"id": "call_stub", "name": "search", "arguments": "{\"queries\":[\"stub\"]}", "result": "", "status": "completed"}}}</glm_block>`},
+			{Phase: "tool_call", EditContent: `<glm_block view="">{"type": "mcp", "data": {"metadata": {"name": "search", "status": "completed"}}, "search_result": [{"title": "Stub Result One", "url": "https://example.com/one", "index": 1, "ref_id": "turn0search0"}, {"title": "Stub Result Two", "url": "https://example.com/two", "index": 2, "ref_id": "turn0search1"}]}</glm_block>`},
+		}
+		return append(script, answerEvents("According to the sources【turn0search0】 this is a stub【turn0search1】.")...), true
+	case "tool_call":
+		call := `<tool_call>{"name": "get_weather", "arguments": {"city": "Beijing"}}</tool_call>`
+		return append(answerEvents("Let me check. "), Event{Phase: "answer", DeltaContent: call}), true
+	case "empty":
+		return Script{}, true
+	case "error":
+		return append(answerEvents("This answer will be interrupted "), Event{Error: "stub upstream error"}), true
+	case "truncated":
+		return append(answerEvents("This answer is cut off "), Event{Abort: true}), true
+	}
+	return nil, false
+}
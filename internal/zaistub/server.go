@@ -0,0 +1,218 @@
+// Package zaistub 是一个模拟 z.ai 网页接口的本地服务，用于离线集成测试和演示
+package zaistub
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FeVersion 是首页中返回的前端版本号
+const FeVersion = "prod-fe-1.0.0"
+
+var scriptTagPattern = regexp.MustCompile(`stub:([\w-]+)`)
+
+type Server struct {
+	// 自定义脚本，优先于内置场景
+	Scripts map[string]Script
+	// 每个事件之间的延迟
+	Delay time.Duration
+	// /api/models 返回的上游模型 ID
+	Models []string
+}
+
+// DefaultModels 是模型列表接口默认返回的上游模型
+var DefaultModels = []string{"0727-360B-API", "GLM-4-6-API-V1", "glm-4.7", "glm-4.5v", "glm-4.6v", "0727-106B-API"}
+
+func NewServer(scripts map[string]Script, delay time.Duration) *Server {
+	return &Server{Scripts: scripts, Delay: delay, Models: DefaultModels}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleHome)
+	mux.HandleFunc("/api/v1/auths/", s.handleAuth)
+	mux.HandleFunc("/api/v1/files/", s.handleUpload)
+	mux.HandleFunc("/api/models", s.handleModels)
+	mux.HandleFunc("/api/v2/chat/completions", s.handleChat)
+	return mux
+}
+
+// handleHome 返回包含前端版本号的首页
+func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprintf(w, `<!doctype html><html><head><script src="/_app/%s/start.js"></script></head><body>zai-stub</body></html>`, FeVersion)
+}
+
+// handleAuth 签发匿名 token，格式与 z.ai 一致，签名部分不做校验
+func (s *Server) handleAuth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"id":    uuid.New().String(),
+		"token": NewToken(uuid.New().String(), time.Hour),
+		"role":  "guest",
+	})
+}
+
+// NewToken 生成一个 payload 含 id 和 exp 的 JWT
+func NewToken(userID string, ttl time.Duration) string {
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, _ := json.Marshal(map[string]interface{}{
+		"id":  userID,
+		"exp": time.Now().Add(ttl).Unix(),
+	})
+	return header + "." + enc.EncodeToString(payload) + ".stub-signature"
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Missing file", http.StatusBadRequest)
+		return
+	}
+	file.Close()
+
+	id := uuid.New().String()
+	writeJSON(w, map[string]interface{}{
+		"id":       id,
+		"user_id":  "stub-user",
+		"filename": header.Filename,
+		"meta": map[string]interface{}{
+			"name":         header.Filename,
+			"content_type": header.Header.Get("Content-Type"),
+			"size":         header.Size,
+			"cdn_url":      "",
+		},
+	})
+}
+
+// handleModels 返回与 z.ai 格式一致的模型列表，名称以 v 结尾的模型标记为支持图片
+func (s *Server) handleModels(w http.ResponseWriter, r *http.Request) {
+	var data []map[string]interface{}
+	for _, id := range s.Models {
+		vision := strings.HasSuffix(id, "v")
+		data = append(data, map[string]interface{}{
+			"id":       id,
+			"name":     strings.ToUpper(id),
+			"owned_by": "openai",
+			"info": map[string]interface{}{
+				"id":        id,
+				"is_active": true,
+				"meta": map[string]interface{}{
+					"capabilities": map[string]interface{}{
+						"vision":     vision,
+						"think":      true,
+						"web_search": !vision,
+					},
+				},
+			},
+		})
+	}
+	writeJSON(w, map[string]interface{}{"data": data})
+}
+
+type chatRequest struct {
+	Model           string                   `json:"model"`
+	Messages        []map[string]interface{} `json:"messages"`
+	SignaturePrompt string                   `json:"signature_prompt"`
+	Features        struct {
+		EnableThinking bool `json:"enable_thinking"`
+		AutoWebSearch  bool `json:"auto_web_search"`
+	} `json:"features"`
+}
+
+// handleChat 按脚本输出 SSE 事件
+// 用户消息中的 "stub:<name>" 选择场景，否则根据 enable_thinking / auto_web_search 选择内置场景
+func (s *Server) handleChat(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		w.WriteHeader(http.StatusUnauthorized)
+		writeJSON(w, map[string]string{"detail": "Not authenticated"})
+		return
+	}
+	var req chatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	name := "answer"
+	if req.Features.EnableThinking {
+		name = "thinking"
+	} else if req.Features.AutoWebSearch {
+		name = "search"
+	}
+	if m := scriptTagPattern.FindStringSubmatch(req.SignaturePrompt); m != nil {
+		name = m[1]
+	}
+
+	script, ok := s.Scripts[name]
+	if !ok {
+		script, ok = builtinScript(name, req.SignaturePrompt)
+	}
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"detail": fmt.Sprintf("unknown stub script %q", name)})
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, event := range script {
+		if event.DelayMs > 0 {
+			time.Sleep(time.Duration(event.DelayMs) * time.Millisecond)
+		} else if s.Delay > 0 {
+			time.Sleep(s.Delay)
+		}
+		if event.Abort {
+			return
+		}
+		if event.Error != "" {
+			writeEvent(w, map[string]interface{}{
+				"error": map[string]interface{}{"code": "stub_error", "detail": event.Error},
+				"done":  true,
+			})
+			return
+		}
+		writeEvent(w, map[string]interface{}{
+			"delta_content": event.DeltaContent,
+			"edit_content":  event.EditContent,
+			"phase":         event.Phase,
+			"done":          false,
+		})
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	writeEvent(w, map[string]interface{}{"phase": "done", "done": true})
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, data map[string]interface{}) {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"type": "chat:completion",
+		"data": data,
+	})
+	fmt.Fprintf(w, "data: %s\n\n", payload)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
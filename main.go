@@ -1,15 +1,31 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"zai-proxy/internal"
 )
 
+// 收到退出信号后等待进行中请求完成的最长时间
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	internal.LoadConfig()
 	internal.InitLogger()
+	internal.InitUpstreamClient()
+	internal.InitSigner()
+	internal.InitTokenPool()
+	internal.InitModelRegistry()
+	internal.InitAPIKeys()
+	internal.StartAnonymousTokenManager()
 	internal.StartVersionUpdater()
+	internal.StartModelDiscovery()
 
 	// OpenAI 格式端点
 	http.HandleFunc("/v1/models", internal.HandleModels)
@@ -18,9 +34,35 @@ func main() {
 	// Claude 格式端点
 	http.HandleFunc("/v1/messages", internal.HandleClaudeChatCompletions)
 
-	addr := ":" + internal.Cfg.Port
-	internal.LogInfo("Server starting on %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		internal.LogError("Server failed: %v", err)
+	// 管理端点
+	http.HandleFunc("/admin/tokens", internal.HandleAdminTokens)
+	http.HandleFunc("/admin/keys", internal.HandleAdminKeys)
+	http.HandleFunc("/admin/keys/", internal.HandleAdminKeys)
+	http.HandleFunc("/admin/models", internal.HandleAdminModels)
+	http.HandleFunc("/admin/signer", internal.HandleAdminSigner)
+	http.HandleFunc("/admin/signer/test", internal.HandleAdminSigner)
+	http.HandleFunc("/admin/version", internal.HandleAdminVersion)
+	http.HandleFunc("/metrics", internal.HandleMetrics)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: ":" + internal.Cfg.Port}
+	go func() {
+		internal.LogInfo("Server starting on %s", server.Addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			internal.LogError("Server failed: %v", err)
+			stop()
+		}
+	}()
+
+	<-ctx.Done()
+	internal.LogInfo("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		internal.LogWarn("Shutdown did not finish in time: %v", err)
 	}
+	// 退出前写入尚未保存的 key 用量
+	internal.FlushAPIKeyUsage()
 }